@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Admin API, authenticated with HPUSH_ADMIN_KEY as the
+// basic auth password:
+//
+//	PUT    /admin/apps/{app}/key     store platform key (body)
+//	DELETE /admin/apps/{app}/key     forget platform key
+//	GET    /admin/apps/{app}/tokens  list deploy tokens
+//	POST   /admin/apps/{app}/tokens  issue a token (?ttl=720h&note=ci)
+//	DELETE /admin/tokens/{id}        revoke a token
+//	GET    /admin/apps/{app}/lock    deploy lock status
+//	DELETE /admin/apps/{app}/lock    break the deploy lock
+func handleAdmin(w http.ResponseWriter, r *http.Request) error {
+	if adminKey == "" {
+		http.Error(w, "admin api not configured", 404)
+		return nil
+	}
+	_, pass := getBasicAuth(r.Header.Get("Authorization"))
+	if subtle.ConstantTimeCompare([]byte(pass), []byte(adminKey)) != 1 {
+		http.Error(w, "unauthorized", 401)
+		return nil
+	}
+	p := strings.Split(r.URL.Path, "/")
+	if len(p) == 3 && p[0] == "apps" && p[2] == "lock" {
+		return adminLock(w, r, p[1])
+	}
+	if creds == nil {
+		http.Error(w, "deploy tokens not enabled", 404)
+		return nil
+	}
+	switch {
+	case len(p) == 3 && p[0] == "apps" && p[2] == "key":
+		return adminKeyReq(w, r, p[1])
+	case len(p) == 3 && p[0] == "apps" && p[2] == "tokens":
+		return adminTokens(w, r, p[1])
+	case len(p) == 2 && p[0] == "tokens" && r.Method == "DELETE":
+		err := creds.Revoke(p[1])
+		if err == errBadToken {
+			http.Error(w, "no such token", 404)
+			return nil
+		}
+		return err
+	}
+	http.NotFound(w, r)
+	return nil
+}
+
+func adminKeyReq(w http.ResponseWriter, r *http.Request, app string) error {
+	switch r.Method {
+	case "PUT":
+		b, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 4096))
+		if err != nil {
+			return err
+		}
+		key := strings.TrimSpace(string(b))
+		if key == "" {
+			http.Error(w, "empty key", 400)
+			return nil
+		}
+		var x struct{ Name string }
+		if err = apiGet(r.Context(), &x, key, "/apps/"+app, ""); err != nil {
+			http.Error(w, "key check failed: "+err.Error(), 400)
+			return nil
+		}
+		return creds.SetKey(app, key)
+	case "DELETE":
+		return creds.DeleteKey(app)
+	}
+	http.Error(w, "method not allowed", 405)
+	return nil
+}
+
+func adminTokens(w http.ResponseWriter, r *http.Request, app string) error {
+	switch r.Method {
+	case "GET":
+		return writeJSON(w, creds.List(app))
+	case "POST":
+		var ttl time.Duration
+		if s := r.FormValue("ttl"); s != "" {
+			var err error
+			if ttl, err = time.ParseDuration(s); err != nil {
+				http.Error(w, "bad ttl: "+err.Error(), 400)
+				return nil
+			}
+		}
+		t, secret, err := creds.NewToken(app, r.FormValue("note"), ttl)
+		if err == errNoKey {
+			http.Error(w, err.Error(), 409)
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c := *t
+		c.Hash = ""
+		return writeJSON(w, struct {
+			token
+			Token string
+		}{c, secret})
+	}
+	http.Error(w, "method not allowed", 405)
+	return nil
+}
+
+func adminLock(w http.ResponseWriter, r *http.Request, app string) error {
+	switch r.Method {
+	case "GET":
+		return writeJSON(w, locks.status(app))
+	case "DELETE":
+		e := locks.forceUnlock(app)
+		if e == nil {
+			http.Error(w, "not locked", 404)
+			return nil
+		}
+		slog.Warn("deploy lock broken", "app", app, "build", e.Build, "since", e.Since)
+		return writeJSON(w, locks.status(app))
+	}
+	http.Error(w, "method not allowed", 405)
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) error {
+	w.Header().Set("Content-Type", "application/json")
+	b, err := json.MarshalIndent(v, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
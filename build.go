@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/kr/hpush/msg"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Why a build was cancelled; see context.Cause.
+var (
+	errCancelRequested = errors.New("cancelled by request")
+	errClientGone      = errors.New("client disconnected")
+)
+
+// A build is a push in progress, from dyno start to release.
+type build struct {
+	ID     string // same as its wconn's ID
+	App    string
+	Dyno   string
+	Start  time.Time
+	key    string
+	ctx    context.Context
+	cancel context.CancelCauseFunc
+	stop   func() // releases the build timer and interrupt hook
+	log    *buildLog
+	logger *slog.Logger
+
+	mu         sync.Mutex
+	State      string // running, succeeded, failed, cancelled, timed out, interrupted
+	rec        buildRecord
+	phaseStart map[string]time.Time
+}
+
+var builds = struct {
+	sync.Mutex
+	m map[string]*build
+}{m: make(map[string]*build)}
+
+// newBuild registers a running build. Its context is done
+// when parent is, when the build is cancelled, when it runs
+// out of time, or when hpush is interrupted.
+func newBuild(parent context.Context, wc *wconn, app, key string) *build {
+	ctx, cancel := context.WithCancelCause(parent)
+	unhook := context.AfterFunc(interrupted, func() {
+		cancel(context.Cause(interrupted))
+	})
+	ctx, stopTimer := withPhaseTimeout(ctx, "build")
+	stop := func() {
+		stopTimer()
+		unhook()
+	}
+	b := &build{
+		ID:     wc.ID,
+		App:    app,
+		Dyno:   wc.psname,
+		Start:  time.Now(),
+		key:    key,
+		ctx:    ctx,
+		cancel: cancel,
+		stop:   stop,
+		log:    openBuildLog(app, wc.ID),
+		logger: wc.logger,
+		State:  "running",
+		rec: buildRecord{
+			ID:     wc.ID,
+			App:    app,
+			Start:  time.Now(),
+			Phases: make(map[string]time.Duration),
+		},
+		phaseStart: make(map[string]time.Time),
+	}
+	builds.Lock()
+	builds.m[b.ID] = b
+	builds.Unlock()
+	return b
+}
+
+func lookupBuild(id string) *build {
+	builds.Lock()
+	defer builds.Unlock()
+	return builds.m[id]
+}
+
+// finish records the final state of b and unregisters it.
+func (b *build) finish(state string) {
+	b.mu.Lock()
+	b.State = state
+	b.rec.State = state
+	b.rec.End = time.Now()
+	rec := b.rec
+	b.mu.Unlock()
+	buildsTotal.inc(state, rec.Reason)
+	if err := history.Add(&rec); err != nil {
+		b.logger.Error("history", "err", err)
+	}
+	b.cancel(nil)
+	b.stop()
+	b.log.Close()
+	builds.Lock()
+	delete(builds.m, b.ID)
+	builds.Unlock()
+	b.logger.Info("build "+state, "state", state, "duration", time.Since(b.Start))
+}
+
+// record updates b's history record with f.
+func (b *build) record(f func(rec *buildRecord)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	f(&b.rec)
+}
+
+// notePhase times a phase from the start and end markers
+// in Phase message p, adding up repeats.
+func (b *build) notePhase(p []byte) {
+	name, start, err := msg.DecodePhase(p)
+	if err != nil {
+		return
+	}
+	b.timePhase(name, start)
+}
+
+// timePhase marks the start or end of the named phase.
+func (b *build) timePhase(name string, start bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if start {
+		b.phaseStart[name] = time.Now()
+	} else if t, ok := b.phaseStart[name]; ok {
+		b.rec.Phases[name] += time.Since(t)
+		delete(b.phaseStart, name)
+		if name == "compile" {
+			compileTime.since(t)
+		}
+	}
+}
+
+// cause says why b's context is done.
+func (b *build) cause() error {
+	err := context.Cause(b.ctx)
+	if err == context.Canceled {
+		err = errClientGone
+	}
+	return err
+}
+
+// validName matches plausible app and build names.
+var validName = regexp.MustCompile("^[a-z0-9][a-z0-9-]*$")
+
+// appAuth reports whether r may act on app. Unlike a push,
+// which proves its key by using it, a request here does
+// nothing with the key, so a platform key is checked with
+// the platform API. If r may not, appAuth writes an error
+// response to w.
+func appAuth(w http.ResponseWriter, r *http.Request, app string) bool {
+	if !validName.MatchString(app) {
+		http.NotFound(w, r)
+		return false
+	}
+	key, ok := appKey(w, r, app)
+	if !ok {
+		return false
+	}
+	_, pass := getBasicAuth(r.Header.Get("Authorization"))
+	if strings.HasPrefix(pass, tokenPrefix) {
+		return true // checked by appKey
+	}
+	var x struct{ Name string }
+	if err := apiGet(r.Context(), &x, key, "/apps/"+app, ""); err != nil {
+		http.Error(w, "unauthorized", 401)
+		return false
+	}
+	return true
+}
+
+// stopDyno stops the one-off build dyno.
+func stopDyno(key, app, name string) error {
+	var x struct{}
+	ctx := context.Background() // the build's context is done by now
+	return apiPost(ctx, &x, key, "/apps/"+app+"/dynos/"+name+"/actions/stop", "", struct{}{})
+}
+
+// handleApps serves per-app resources, authorized like a push
+// except that a platform key is checked before it is trusted:
+//
+//	POST /apps/{app}/builds/{id}/cancel
+//	GET  /apps/{app}/builds  history, newest first (?limit=50)
+//	GET  /apps/{app}/builds/{id}/log
+func handleApps(w http.ResponseWriter, r *http.Request) error {
+	p := strings.Split(r.URL.Path, "/")
+	if len(p) < 2 {
+		http.NotFound(w, r)
+		return nil
+	}
+	app := p[0]
+	if !appAuth(w, r, app) {
+		return nil
+	}
+	switch {
+	case len(p) == 4 && p[1] == "builds" && p[3] == "cancel" && r.Method == "POST":
+		b := lookupBuild(p[2])
+		if b == nil || b.App != app {
+			http.Error(w, "no such running build", 404)
+			return nil
+		}
+		b.cancel(errCancelRequested)
+		w.WriteHeader(http.StatusAccepted)
+		return nil
+	case len(p) == 4 && p[1] == "builds" && p[3] == "log" && r.Method == "GET":
+		return serveLog(w, r, app, p[2])
+	case len(p) == 2 && p[1] == "builds" && r.Method == "GET":
+		limit := 50
+		if s := r.FormValue("limit"); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 1 {
+				http.Error(w, "bad limit", 400)
+				return nil
+			}
+			limit = n
+		}
+		a, err := history.List(app, limit)
+		if err != nil {
+			return err
+		}
+		if a == nil {
+			a = []*buildRecord{}
+		}
+		return writeJSON(w, a)
+	}
+	http.NotFound(w, r)
+	return nil
+}
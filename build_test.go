@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAPI stands in for the platform API, which knows one
+// app, app1, and one key for it, good.
+func fakeAPI(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, key, _ := r.BasicAuth()
+		if r.URL.Path != "/apps/app1" || key != "good" {
+			http.Error(w, "unauthorized", 401)
+			return
+		}
+		w.Write([]byte(`{"name":"app1"}`))
+	}))
+	old := apiURL
+	apiURL = srv.URL
+	t.Cleanup(func() {
+		apiURL = old
+		srv.Close()
+	})
+}
+
+// appsReq makes a request to handleApps, with key as the
+// basic auth password.
+func appsReq(t *testing.T, method, path, key string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, "/apps/"+path, nil)
+	r.SetBasicAuth("", key)
+	w := httptest.NewRecorder()
+	http.StripPrefix("/apps/", errHandler{handleApps}).ServeHTTP(w, r)
+	return w
+}
+
+func TestAppsCancelAuth(t *testing.T) {
+	fakeAPI(t)
+	ctx, cancel := context.WithCancelCause(context.Background())
+	builds.Lock()
+	builds.m["b1"] = &build{ID: "b1", App: "app1", ctx: ctx, cancel: cancel}
+	builds.Unlock()
+	defer func() {
+		builds.Lock()
+		delete(builds.m, "b1")
+		builds.Unlock()
+	}()
+
+	if code := appsReq(t, "POST", "app1/builds/b1/cancel", "x").Code; code != 401 {
+		t.Errorf("bad key: status = %d, want 401", code)
+	}
+	if code := appsReq(t, "POST", "app1/builds/b1/cancel", "").Code; code != 401 {
+		t.Errorf("no key: status = %d, want 401", code)
+	}
+	if ctx.Err() != nil {
+		t.Fatal("build cancelled without a valid key")
+	}
+	if code := appsReq(t, "POST", "app1/builds/b1/cancel", "good").Code; code != 202 {
+		t.Errorf("good key: status = %d, want 202", code)
+	}
+	if context.Cause(ctx) != errCancelRequested {
+		t.Errorf("cause = %v, want %v", context.Cause(ctx), errCancelRequested)
+	}
+}
+
+func TestAppsHistoryAuth(t *testing.T) {
+	fakeAPI(t)
+	old := history
+	history = &fileHistory{path: t.TempDir() + "/builds.jsonl"}
+	defer func() { history = old }()
+	if err := history.Add(&buildRecord{ID: "b1", App: "app1", Requester: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	w := appsReq(t, "GET", "app1/builds", "x")
+	if w.Code != 401 || strings.Contains(w.Body.String(), "alice") {
+		t.Errorf("bad key: status = %d, body = %q; want 401 and no record", w.Code, w.Body)
+	}
+	w = appsReq(t, "GET", "app1/builds", "good")
+	if w.Code != 200 || !strings.Contains(w.Body.String(), "alice") {
+		t.Errorf("good key: status = %d, body = %q; want 200 and the record", w.Code, w.Body)
+	}
+}
+
+func TestAppsLogAuth(t *testing.T) {
+	fakeAPI(t)
+	old := dataDir
+	dataDir = t.TempDir()
+	defer func() { dataDir = old }()
+	path := logPath("app1", "b1")
+	os.MkdirAll(filepath.Dir(path), 0700)
+	if err := os.WriteFile(path, []byte("compile output\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	w := appsReq(t, "GET", "app1/builds/b1/log", "x")
+	if w.Code != 401 || strings.Contains(w.Body.String(), "compile output") {
+		t.Errorf("bad key: status = %d, body = %q; want 401 and no log", w.Code, w.Body)
+	}
+	w = appsReq(t, "GET", "app1/builds/b1/log", "good")
+	if w.Code != 200 || w.Body.String() != "compile output\n" {
+		t.Errorf("good key: status = %d, body = %q; want 200 and the log", w.Code, w.Body)
+	}
+}
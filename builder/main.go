@@ -3,18 +3,24 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"crypto/tls"
 	"fmt"
 	"github.com/kr/hpush/msg"
 	"github.com/kr/tarutil"
 	"io"
 	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"strings"
+	"sync"
 	"syscall"
+	"time"
 )
 
 const (
@@ -23,12 +29,26 @@ const (
 	cacheDir = "/tmp/cache"
 	bpDir    = "/tmp/bp"
 	compile  = bpDir + "/bin/compile"
+	bigSlug  = 300 << 20
+
+	// how long to wait for hpush to hang up once the
+	// outcome is sent; exiting first could reset the
+	// connection before hpush has read it all
+	exitGrace = time.Minute
+)
+
+var (
+	started   = time.Now()
+	phase     string // current build phase, for status reports
+	buildpack string // URL, once known, for status reports
 )
 
 // Communication with hpush proceeds as follows:
+//   0. upgrade the callback request, then exchange hello;
+//      the rest runs on msg.MainChan of a msg.Mux
 //   1. read slug url
 //   2. read tarball
-//   3. write user messages
+//   3. write user messages (User, Stderr, Phase, Progress, Warning)
 //   4. write status
 //   5. if success:
 //      a. write slug
@@ -37,6 +57,21 @@ const (
 func main() {
 	signal.Notify(make(chan os.Signal), syscall.SIGHUP) // ignore
 
+	// Log to the dyno's stderr, which hpush reads, tagged
+	// with the build ID so hpush's logs and ours line up.
+	logfd, err := syscall.Dup(2)
+	if err != nil {
+		panic(err)
+	}
+	logf := os.NewFile(uintptr(logfd), "log")
+	slog.SetDefault(slog.New(slog.NewTextHandler(logf, nil)).With("build", os.Getenv("HPUSH_BUILD_ID")))
+	defer func() {
+		if v := recover(); v != nil {
+			slog.Error("panic", "err", v)
+			panic(v)
+		}
+	}()
+
 	devNull, err := os.Open(os.DevNull)
 	if err != nil {
 		panic(err)
@@ -49,21 +84,40 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
+	token, pin := os.Getenv("HPUSH_TOKEN"), os.Getenv("HPUSH_PIN")
+	idle, _ := time.ParseDuration(os.Getenv("HPUSH_IDLE_TIMEOUT"))
+	parseTimeouts(os.Getenv("HPUSH_TIMEOUTS"))
+	os.Unsetenv("HPUSH_TOKEN") // keep it from the buildpack
 	u, err := url.Parse(os.Args[1])
 	if err != nil {
 		panic(err)
 	}
-	addr, err := net.ResolveTCPAddr("tcp", u.Host)
+	conn, err := dial(u, pin)
 	if err != nil {
 		panic(err)
 	}
-	c, err := net.DialTCP("tcp", nil, addr)
+	id := path.Base(u.Path)
+	auth := msg.Auth(token, id, time.Now())
+	err = msg.Upgrade(conn, u, auth)
 	if err != nil {
 		panic(err)
 	}
-	io.WriteString(c, "X "+u.Path+" HTTP/1.1\r\n\r\n")
 
-	t, slugURL, err := msg.ReadFull(c)
+	caps, err := msg.Handshake(conn, []string{msg.CapDeflate})
+	if err != nil {
+		// hpush can't understand us; nobody to tell
+		panic(err)
+	}
+	slog.Info("connected", "caps", caps)
+	mux := msg.NewMux(conn, idle)
+	var mc io.ReadWriter = mux.Channel(msg.MainChan)
+	if msg.HasCap(caps, msg.CapDeflate) {
+		mc = msg.Compress(mc)
+	}
+	c := &stream{Reader: msg.NewReader(mc), Writer: msg.NewWriter(mc), mux: mux}
+	go watchControl(c, mux.Channel(msg.ControlChan))
+
+	t, slugURL, err := c.ReadFull()
 	if err != nil {
 		fail(c, err)
 	}
@@ -71,7 +125,7 @@ func main() {
 		fail(c, fmt.Sprintf("wanted file, got %d\n", t))
 	}
 
-	r, err := msg.ReadFile(c)
+	r, err := c.ReadFile()
 	if err != nil {
 		fail(c, err)
 	}
@@ -79,7 +133,7 @@ func main() {
 	if err != nil {
 		fail(c, err)
 	}
-	msg.Write(c, msg.User, []byte(fmt.Sprintf("read tarball\n")))
+	c.send(msg.User, []byte(fmt.Sprintf("read tarball\n")))
 	err = os.MkdirAll(buildDir, 0777)
 	if err != nil {
 		fail(c, err)
@@ -88,7 +142,7 @@ func main() {
 	if err != nil {
 		fail(c, err)
 	}
-	msg.Write(c, msg.User, []byte("extracted\n"))
+	c.send(msg.User, []byte("extracted\n"))
 	err = os.MkdirAll(cacheDir, 0777)
 	if err != nil {
 		fail(c, err)
@@ -96,48 +150,53 @@ func main() {
 
 	bpurl := os.Getenv("BUILDPACK_URL")
 	if bpurl == "" {
-		errorExit(c, "no BUILDPACK_URL\n")
+		errorExit(c, msg.ReasonBuildpackFetch, 0, "no BUILDPACK_URL\n")
 	}
 	u, urlerr := url.Parse(bpurl)
+	buildpack = bpurl
 	if urlerr == nil && u.Fragment != "" {
 		bpurl = bpurl[:len(bpurl)-len(u.Fragment)-1]
 	}
-	msg.Write(c, msg.User, []byte("fetching buildpack\n"))
-	msg.Write(c, msg.User, []byte(bpurl+"\n"))
-	cmd := exec.Command("git", "clone", bpurl, bpDir)
-	err = cmd.Run()
+	startPhase(c, "fetch")
+	c.send(msg.User, []byte(bpurl+"\n"))
+	err = run(exec.Command("git", "clone", bpurl, bpDir))
 	if err != nil {
-		msg.Write(c, msg.User, []byte(err.Error()+"\n"))
-		errorExit(c, "failed to fetch buildpack\n")
+		c.send(msg.User, []byte(err.Error()+"\n"))
+		errorExit(c, msg.ReasonBuildpackFetch, exitCode(err), "failed to fetch buildpack\n")
 	}
 	if urlerr == nil && u.Fragment != "" {
-		msg.Write(c, msg.User, []byte("git checkout "+u.Fragment+"\n"))
+		c.send(msg.User, []byte("git checkout "+u.Fragment+"\n"))
 		cmd := exec.Command("git", "checkout", u.Fragment)
 		cmd.Dir = bpDir
-		err = cmd.Run()
+		err = run(cmd)
 		if err != nil {
-			msg.Write(c, msg.User, []byte(err.Error()+"\n"))
-			errorExit(c, "failed to check out ref: "+u.Fragment+"\n")
+			c.send(msg.User, []byte(err.Error()+"\n"))
+			errorExit(c, msg.ReasonBuildpackFetch, exitCode(err), "failed to check out ref: "+u.Fragment+"\n")
 		}
 	}
+	endPhase(c)
 	err = os.RemoveAll(buildDir + "/.git")
 	if err != nil {
-		msg.Write(c, msg.User, []byte(err.Error()+"\n"))
-		errorExit(c, "failed to clean .git dir\n")
+		c.send(msg.User, []byte(err.Error()+"\n"))
+		errorExit(c, msg.ReasonInternal, 0, "failed to clean .git dir\n")
 	}
 
-	msg.Write(c, msg.User, []byte("compiling\n"))
-	cmd = exec.Command(compile, buildDir, cacheDir)
-	cmd.Stdout = msg.LineWriter(c, msg.User)
-	cmd.Stderr = cmd.Stdout
-	err = cmd.Run()
+	startPhase(c, "compile")
+	cmd := exec.Command(compile, buildDir, cacheDir)
+	stdout := msg.NewLineWriter(c.Writer, msg.User)
+	stderr := msg.NewLineWriter(c.Writer, msg.Stderr)
+	cmd.Stdout, cmd.Stderr = stdout, stderr
+	err = run(cmd)
+	stdout.Close()
+	stderr.Close()
 	if ee, ok := err.(*exec.ExitError); ok {
-		errorExit(c, "buildpack failed: "+ee.Error()+"\n")
+		errorExit(c, msg.ReasonCompile, ee.ExitCode(), "buildpack failed: "+ee.Error()+"\n")
 	}
 	if err != nil {
 		fail(c, err)
 	}
-	msg.Write(c, msg.User, []byte("buildpack done\n"))
+	endPhase(c)
+	startPhase(c, "pack")
 	slug, err := tempFile()
 	if err != nil {
 		fail(c, err)
@@ -152,50 +211,206 @@ func main() {
 		fail(c, err)
 	}
 	slug.Seek(0, 0)
-	msg.Write(c, msg.User, []byte("slug built\n"))
 	fi, err := slug.Stat()
 	if err != nil {
 		fail(c, err)
 	}
-	msg.Write(c, msg.User, []byte(fmt.Sprintf("slug %d bytes\n", fi.Size())))
+	c.send(msg.User, []byte(fmt.Sprintf("slug %d bytes\n", fi.Size())))
+	if fi.Size() > bigSlug {
+		c.send(msg.Warning, []byte(fmt.Sprintf("slug is %d MB; slugs over %d MB are slow to boot\n", fi.Size()>>20, bigSlug>>20)))
+	}
+	endPhase(c)
 
 	_ = slugURL
 
 	procfile := readProcfile()
 	if procfile == nil {
-		fail(c, "could not read procfile")
+		errorExit(c, msg.ReasonProcfile, 0, "could not read procfile\n")
 	}
-	msg.Write(c, msg.Status, []byte{msg.Success})
-	err = msg.CopyN(c, msg.File, slug, fi.Size())
+	slog.Info("build ok", "duration", time.Since(started), "slug_size", fi.Size())
+	c.finish(func() error {
+		c.WriteMsg(msg.Status, msg.EncodeStatus(msg.Result{Code: msg.Success, Duration: time.Since(started), Buildpack: buildpack}))
+		// the slug is gzipped already
+		if err := c.CopyNRaw(msg.File, slug, fi.Size()); err != nil {
+			return err
+		}
+		c.WriteMsg(msg.File, procfile)
+		return c.Flush()
+	})
+}
+
+// dial connects to hpush, over TLS if u is https,
+// accepting only the certificate matching pin, if any.
+func dial(u *url.URL, pin string) (net.Conn, error) {
+	host := u.Host
+	if u.Port() == "" && u.Scheme == "https" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	} else if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	if u.Scheme == "https" {
+		config := msg.PinnedTLSConfig(pin)
+		config.ServerName = u.Hostname()
+		return tls.Dial("tcp", host, config)
+	}
+	addr, err := net.ResolveTCPAddr("tcp", host)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	err = msg.Write(c, msg.File, procfile)
-	if err != nil {
-		panic(err)
+	return net.DialTCP("tcp", nil, addr)
+}
+
+var (
+	runMu      sync.Mutex
+	running    *exec.Cmd // command run is waiting on, if any
+	cancelled  bool      // abort has been called
+	phaseTimer *time.Timer
+)
+
+// timeouts for each phase, from hpush; see ../timeouts.go
+var timeouts = make(map[string]time.Duration)
+
+// parseTimeouts parses name=duration pairs separated by commas.
+func parseTimeouts(s string) {
+	for _, f := range strings.Split(s, ",") {
+		kv := strings.SplitN(f, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		if d, err := time.ParseDuration(kv[1]); err == nil {
+			timeouts[kv[0]] = d
+		}
 	}
-	_, err = io.Copy(ioutil.Discard, c) // wait until other side closes
+}
+
+// run runs cmd in its own process group, so that a cancel
+// can kill it along with its children.
+func run(cmd *exec.Cmd) error {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	runMu.Lock()
+	if cancelled {
+		runMu.Unlock()
+		select {} // abort exits the process
+	}
+	err := cmd.Start()
+	if err == nil {
+		running = cmd
+	}
+	runMu.Unlock()
 	if err != nil {
-		panic(err)
+		return err
+	}
+	err = cmd.Wait()
+	runMu.Lock()
+	running = nil
+	if cancelled {
+		runMu.Unlock()
+		select {}
 	}
+	runMu.Unlock()
+	return err
 }
 
-func fail(c net.Conn, err interface{}) {
-	msg.Write(c, msg.User, []byte(fmt.Sprintf("%v\n", err)))
-	errorExit(c, "internal error\n")
-	panic(err)
+// watchControl handles requests from hpush on ctl.
+func watchControl(c *stream, ctl io.Reader) {
+	r := msg.NewReader(ctl)
+	for {
+		t, p, err := r.ReadFull()
+		if err != nil {
+			return
+		}
+		if t == msg.Cancel {
+			abort(c, msg.ReasonCancelled, "build cancelled: "+string(p)+"\n")
+		}
+	}
 }
 
-func errorExit(c net.Conn, s string) {
-	msg.Write(c, msg.User, []byte(s))
-	msg.Write(c, msg.Status, []byte{msg.Failure})
-	_, err := io.Copy(ioutil.Discard, c) // wait until other side closes
-	if err != nil {
-		panic(err)
+// abort kills the running command, if any, and reports
+// failure for reason. Only the first call has any effect.
+func abort(c *stream, reason, s string) {
+	runMu.Lock()
+	if cancelled {
+		runMu.Unlock()
+		return
+	}
+	cancelled = true
+	if running != nil {
+		syscall.Kill(-running.Process.Pid, syscall.SIGKILL)
 	}
+	runMu.Unlock()
+	errorExit(c, reason, 0, s)
+}
+
+// startPhase tells hpush phase name has begun, and starts
+// its timer, if it has a timeout.
+func startPhase(c *stream, name string) {
+	runMu.Lock()
+	phase = name
+	if d := timeouts[name]; d > 0 {
+		phaseTimer = time.AfterFunc(d, func() {
+			abort(c, msg.ReasonTimeout, fmt.Sprintf("%s timed out after %v\n", name, d))
+		})
+	}
+	runMu.Unlock()
+	slog.Info("phase", "name", name)
+	c.send(msg.Phase, msg.EncodePhase(name, true))
+}
+
+func endPhase(c *stream) {
+	runMu.Lock()
+	if phaseTimer != nil {
+		phaseTimer.Stop()
+		phaseTimer = nil
+	}
+	name := phase
+	phase = ""
+	if cancelled {
+		runMu.Unlock()
+		select {} // abort exits the process
+	}
+	runMu.Unlock()
+	c.send(msg.Phase, msg.EncodePhase(name, false))
+}
+
+func currentPhase() string {
+	runMu.Lock()
+	defer runMu.Unlock()
+	return phase
+}
+
+func fail(c *stream, err interface{}) {
+	slog.Error("internal error", "phase", currentPhase(), "err", err)
+	c.send(msg.User, []byte(fmt.Sprintf("%v\n", err)))
+	errorExit(c, msg.ReasonInternal, 0, "internal error\n")
+	panic(err)
+}
+
+// errorExit tells hpush the build failed in the current
+// phase for reason, with exit status code (or 0), and exits.
+func errorExit(c *stream, reason string, code int, s string) {
+	slog.Info("build failed", "reason", reason, "phase", currentPhase(), "exit", code)
+	c.finish(func() error {
+		c.WriteMsg(msg.User, []byte(s))
+		c.WriteMsg(msg.Status, msg.EncodeStatus(msg.Result{
+			Code:      msg.Failure,
+			ExitCode:  code,
+			Phase:     currentPhase(),
+			Reason:    reason,
+			Duration:  time.Since(started),
+			Buildpack: buildpack,
+		}))
+		return c.Flush()
+	})
 	os.Exit(1)
 }
 
+func exitCode(err error) int {
+	if ee, ok := err.(*exec.ExitError); ok {
+		return ee.ExitCode()
+	}
+	return 0
+}
+
 func readProcfile() []byte {
 	b, _ := ioutil.ReadFile(buildDir + "/Procfile")
 	return b
@@ -229,8 +444,17 @@ func tempFile() (f *os.File, err error) {
 	return f, nil
 }
 
-func entar(w io.Writer, dir string, ww io.Writer) error {
-	msg.Write(ww, msg.User, []byte("entar\n"))
+// entar writes dir as a tarball to w, reporting progress in
+// bytes to c at most once a second.
+func entar(w io.Writer, dir string, c *stream) error {
+	var total, done int64
+	filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			total += fi.Size()
+		}
+		return nil
+	})
+	last := time.Now()
 	tw := tar.NewWriter(w)
 	err := filepath.Walk(dir, func(path string, fi os.FileInfo, err error) error {
 		if err != nil {
@@ -254,7 +478,14 @@ func entar(w io.Writer, dir string, ww io.Writer) error {
 			if err != nil {
 				return err
 			}
-			_, err = io.Copy(tw, f)
+			var n int64
+			n, err = io.Copy(tw, f)
+			f.Close()
+			done += n
+			if time.Since(last) > time.Second {
+				c.send(msg.Progress, msg.EncodeProgress("pack", done, total))
+				last = time.Now()
+			}
 		}
 		return err
 	})
@@ -263,3 +494,51 @@ func entar(w io.Writer, dir string, ww io.Writer) error {
 	}
 	return tw.Close()
 }
+
+// A stream is the builder's end of the main channel. The
+// control watcher or a phase timer may abort the build at
+// any time, so the build's outcome, success or failure, goes
+// out through finish, which lets only the first through.
+type stream struct {
+	*msg.Reader
+	*msg.Writer
+	mux *msg.Mux
+
+	mu   sync.Mutex
+	over bool // the outcome has been sent
+}
+
+// send writes a message to hpush right away. Once the
+// outcome has been sent, it blocks forever: the process is
+// on its way out.
+func (c *stream) send(t byte, p []byte) error {
+	c.mu.Lock()
+	if c.over {
+		c.mu.Unlock()
+		select {}
+	}
+	defer c.mu.Unlock()
+	c.WriteMsg(t, p)
+	return c.Flush()
+}
+
+// finish sends the build's outcome with f, then waits for
+// hpush to hang up, up to exitGrace. If an outcome has been
+// sent already, finish blocks forever.
+func (c *stream) finish(f func() error) {
+	c.mu.Lock()
+	if c.over {
+		c.mu.Unlock()
+		select {}
+	}
+	c.over = true
+	err := f()
+	c.mu.Unlock()
+	if err != nil {
+		panic(err)
+	}
+	select {
+	case <-c.mux.Done():
+	case <-time.After(exitGrace):
+	}
+}
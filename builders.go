@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// A builderBin is one builder executable, for one OS and
+// architecture, and optionally only for one stack.
+type builderBin struct {
+	Stack string // empty means any stack
+	OS    string // GOOS
+	Arch  string // GOARCH
+	Path  string
+	Sum   string // hex sha256 of the file
+}
+
+// builders is set once at startup and read-only after.
+// Binaries are served content-addressed at /builder/{sum},
+// and the default one at /builder.
+var (
+	builders      []*builderBin
+	defaultBinary *builderBin
+)
+
+// uname output for each GOOS and GOARCH we know how
+// to build for, as shell case patterns.
+var (
+	unameOS = map[string]string{
+		"linux":   "Linux",
+		"darwin":  "Darwin",
+		"freebsd": "FreeBSD",
+	}
+	unameArch = map[string][]string{
+		"amd64":   {"x86_64", "amd64"},
+		"arm64":   {"aarch64", "arm64"},
+		"386":     {"i386", "i686"},
+		"arm":     {"armv6l", "armv7l"},
+		"ppc64le": {"ppc64le"},
+		"s390x":   {"s390x"},
+	}
+)
+
+// builderName matches the name of a builder binary in the
+// builders directory, capturing GOOS and GOARCH. Anything
+// else there, such as builder-linux-amd64.sha256 or an
+// editor's backup, is not a builder.
+var builderName = regexp.MustCompile("^builder-([a-z0-9]+)-([a-z0-9]+)$")
+
+// loadBuilders registers the builder found in $PATH, taken
+// to be for the OS and arch hpush itself runs on, and any
+// binaries in dir. In dir, builder-{os}-{arch} is for any
+// stack, and {stack}/builder-{os}-{arch} for that stack.
+// Other files there are logged and skipped.
+func loadBuilders(dir string) error {
+	if path, err := exec.LookPath("builder"); err == nil {
+		b, err := newBuilderBin(path, "", runtime.GOOS, runtime.GOARCH)
+		if err != nil {
+			return err
+		}
+		defaultBinary = b
+		builders = append(builders, b)
+	}
+	if dir != "" {
+		for _, pat := range []string{"builder-*-*", "*/builder-*-*"} {
+			paths, err := filepath.Glob(filepath.Join(dir, pat))
+			if err != nil {
+				return err
+			}
+			for _, path := range paths {
+				stack := filepath.Base(filepath.Dir(path))
+				if filepath.Dir(path) == filepath.Clean(dir) {
+					stack = ""
+				}
+				m := builderName.FindStringSubmatch(filepath.Base(path))
+				fi, err := os.Stat(path)
+				if m == nil || stack != "" && !validName.MatchString(stack) || err != nil || !fi.Mode().IsRegular() {
+					slog.Warn("not a builder, ignoring", "path", path)
+					continue
+				}
+				b, err := newBuilderBin(path, stack, m[1], m[2])
+				if err != nil {
+					return err
+				}
+				builders = append(builders, b)
+			}
+		}
+	}
+	if len(builders) == 0 {
+		return errors.New("no builder binaries found")
+	}
+	if defaultBinary == nil {
+		defaultBinary = builders[0]
+	}
+	return nil
+}
+
+func newBuilderBin(path, stack, goos, goarch string) (*builderBin, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return &builderBin{
+		Stack: stack,
+		OS:    goos,
+		Arch:  goarch,
+		Path:  path,
+		Sum:   sha256hex(b),
+	}, nil
+}
+
+// buildersFor returns the builder to use for each OS and arch
+// on stack, preferring ones specific to that stack.
+func buildersFor(stack string) []*builderBin {
+	m := make(map[string]*builderBin)
+	for _, b := range builders {
+		k := b.OS + "/" + b.Arch
+		if b.Stack == "" && m[k] == nil || b.Stack == stack && stack != "" {
+			m[k] = b
+		}
+	}
+	var a []*builderBin
+	for _, b := range m {
+		a = append(a, b)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Path < a[j].Path })
+	return a
+}
+
+// Uname returns a shell case pattern matching the output of
+// "uname -s"/"uname -m" on the system b runs on.
+func (b *builderBin) Uname() string {
+	sys := unameOS[b.OS]
+	if sys == "" {
+		sys = b.OS
+	}
+	arch := unameArch[b.Arch]
+	if arch == nil {
+		arch = []string{b.Arch}
+	}
+	var a []string
+	for _, s := range arch {
+		a = append(a, sys+"/"+s)
+	}
+	return strings.Join(a, "|")
+}
+
+func handleBuilder(w http.ResponseWriter, r *http.Request) {
+	sum := strings.TrimPrefix(r.URL.Path, "/builder")
+	sum = strings.TrimPrefix(sum, "/")
+	if sum == "" {
+		http.ServeFile(w, r, defaultBinary.Path)
+		return
+	}
+	for _, b := range builders {
+		if b.Sum == sum {
+			http.ServeFile(w, r, b.Path)
+			return
+		}
+	}
+	http.NotFound(w, r)
+}
+
+// appStack returns the name of app's stack.
+func appStack(key, app string) (string, error) {
+	var x struct {
+		Stack struct{ Name string }
+	}
+	err := apiGet(context.Background(), &x, key, "/apps/"+app, "")
+	return x.Stack.Name, err
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// saveBuilders restores the registered builders after t.
+func saveBuilders(t *testing.T) {
+	old, oldDefault := builders, defaultBinary
+	builders, defaultBinary = nil, nil
+	t.Cleanup(func() { builders, defaultBinary = old, oldDefault })
+}
+
+func TestLoadBuilders(t *testing.T) {
+	cases := []struct {
+		files []string
+		w     []string // stack/os/arch
+	}{
+		{
+			[]string{"builder-linux-amd64", "heroku-22/builder-linux-arm64"},
+			[]string{"/linux/amd64", "heroku-22/linux/arm64"},
+		},
+		{
+			[]string{
+				"builder-darwin-arm64",
+				"builder-linux-amd64.sha256",
+				"builder-linux-amd64~",
+				"builder-linux-amd64-v2",
+				"builder-Linux-amd64",
+				"builder-linux-",
+				"builder-linux-386/README",
+				"Heroku 22/builder-linux-amd64",
+			},
+			[]string{"/darwin/arm64"},
+		},
+		{[]string{"builder-linux-amd64.sha256"}, nil},
+	}
+	t.Setenv("PATH", t.TempDir())
+	for _, c := range cases {
+		saveBuilders(t)
+		dir := t.TempDir()
+		for _, name := range c.files {
+			path := filepath.Join(dir, name)
+			os.MkdirAll(filepath.Dir(path), 0755)
+			if err := os.WriteFile(path, []byte(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := loadBuilders(dir)
+		if c.w == nil {
+			if err == nil {
+				t.Errorf("loadBuilders(%q) found %d builders, want error", c.files, len(builders))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("loadBuilders(%q): %v", c.files, err)
+			continue
+		}
+		var g []string
+		for _, b := range builders {
+			g = append(g, b.Stack+"/"+b.OS+"/"+b.Arch)
+		}
+		sort.Strings(g)
+		if !reflect.DeepEqual(g, c.w) {
+			t.Errorf("loadBuilders(%q) = %q, want %q", c.files, g, c.w)
+		}
+		if defaultBinary != builders[0] {
+			t.Errorf("loadBuilders(%q): default %v, want first", c.files, defaultBinary)
+		}
+	}
+}
+
+// The builder in $PATH is the default, for hpush's own
+// OS and arch.
+func TestLoadBuildersPath(t *testing.T) {
+	saveBuilders(t)
+	bin := t.TempDir()
+	if err := os.WriteFile(filepath.Join(bin, "builder"), []byte("x"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "builder-linux-s390x"), []byte("y"), 0755)
+	if err := loadBuilders(dir); err != nil {
+		t.Fatal(err)
+	}
+	if len(builders) != 2 || defaultBinary != builders[0] || defaultBinary.Path != filepath.Join(bin, "builder") {
+		t.Errorf("default %v of %d, want %s", defaultBinary, len(builders), filepath.Join(bin, "builder"))
+	}
+}
+
+func TestBuildersFor(t *testing.T) {
+	saveBuilders(t)
+	builders = []*builderBin{
+		{OS: "linux", Arch: "amd64", Path: "a"},
+		{OS: "linux", Arch: "arm64", Path: "b"},
+		{Stack: "heroku-22", OS: "linux", Arch: "amd64", Path: "c"},
+		{Stack: "heroku-24", OS: "linux", Arch: "amd64", Path: "d"},
+	}
+	cases := []struct {
+		stack string
+		w     []string
+	}{
+		{"", []string{"a", "b"}},
+		{"heroku-22", []string{"b", "c"}},
+		{"heroku-24", []string{"b", "d"}},
+		{"cedar-14", []string{"a", "b"}},
+	}
+	for _, c := range cases {
+		var g []string
+		for _, b := range buildersFor(c.stack) {
+			g = append(g, b.Path)
+		}
+		if !reflect.DeepEqual(g, c.w) {
+			t.Errorf("buildersFor(%q) = %q, want %q", c.stack, g, c.w)
+		}
+	}
+}
+
+func TestUname(t *testing.T) {
+	cases := []struct {
+		os, arch string
+		w        string
+	}{
+		{"linux", "amd64", "Linux/x86_64|Linux/amd64"},
+		{"darwin", "arm64", "Darwin/aarch64|Darwin/arm64"},
+		{"linux", "arm", "Linux/armv6l|Linux/armv7l"},
+		{"linux", "riscv64", "Linux/riscv64"},
+		{"plan9", "386", "plan9/i386|plan9/i686"},
+	}
+	for _, c := range cases {
+		b := &builderBin{OS: c.os, Arch: c.arch}
+		if g := b.Uname(); g != c.w {
+			t.Errorf("Uname(%s/%s) = %q, want %q", c.os, c.arch, g, c.w)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Each build's log, everything its client was sent plus the
+// dyno's attach output, is kept in {dataDir}/logs/{app}/{id}.log
+// for HPUSH_LOG_MAX_AGE (default a week), up to
+// HPUSH_LOG_MAX_SIZE bytes (default 10MB) per build.
+var (
+	logMaxAge  = 7 * 24 * time.Hour
+	logMaxSize = int64(10 << 20)
+)
+
+var ansiEscape = regexp.MustCompile("\x1b\\[[0-9;]*[A-Za-z]")
+
+func logDir() string {
+	return filepath.Join(dataDir, "logs")
+}
+
+// logPath returns the path of the log for build id of app,
+// or "" if either is not a plausible name.
+func logPath(app, id string) string {
+	if !validName.MatchString(app) || !validName.MatchString(id) {
+		return ""
+	}
+	return filepath.Join(logDir(), app, id+".log")
+}
+
+// A buildLog is a build's log file. It drops colour codes,
+// and writes to it never fail, so as not to disturb the
+// build. A nil *buildLog discards everything.
+type buildLog struct {
+	mu     sync.Mutex
+	f      *os.File
+	n      int64
+	closed bool
+}
+
+// openBuildLog creates the log for build id of app. On
+// error, it logs why and returns nil.
+func openBuildLog(app, id string) *buildLog {
+	go pruneLogs()
+	path := logPath(app, id)
+	if path == "" {
+		slog.Error("build log: bad name", "build", id, "app", app)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		slog.Error("build log", "build", id, "app", app, "err", err)
+		return nil
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		slog.Error("build log", "build", id, "app", app, "err", err)
+		return nil
+	}
+	return &buildLog{f: f}
+}
+
+func (l *buildLog) Write(p []byte) (int, error) {
+	if l == nil {
+		return len(p), nil
+	}
+	q := ansiEscape.ReplaceAll(p, nil)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed || l.n > logMaxSize {
+		return len(p), nil
+	}
+	if l.n+int64(len(q)) > logMaxSize {
+		q = append(q[:logMaxSize-l.n:logMaxSize-l.n], "\n[log truncated]\n"...)
+	}
+	n, err := l.f.Write(q)
+	l.n += int64(n)
+	if err != nil {
+		slog.Error("build log", "path", l.f.Name(), "err", err)
+		l.n = logMaxSize + 1 // stop trying
+	}
+	return len(p), nil
+}
+
+func (l *buildLog) Close() error {
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.closed {
+		return nil
+	}
+	l.closed = true
+	return l.f.Close()
+}
+
+// prefixed returns a writer that adds prefix to each line
+// it writes to l.
+func (l *buildLog) prefixed(prefix string) io.Writer {
+	return &prefixWriter{w: l, prefix: []byte(prefix), bol: true}
+}
+
+type prefixWriter struct {
+	w      io.Writer
+	prefix []byte
+	bol    bool // at the beginning of a line
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	n := len(p)
+	var b []byte
+	for len(p) > 0 {
+		if w.bol {
+			b = append(b, w.prefix...)
+		}
+		i := bytes.IndexByte(p, '\n') + 1
+		if i == 0 {
+			i = len(p)
+		}
+		b = append(b, p[:i]...)
+		w.bol = p[i-1] == '\n'
+		p = p[i:]
+	}
+	_, err := w.w.Write(b)
+	return n, err
+}
+
+// A redactor writes to w what is written to it, with each
+// occurrence of secret replaced. It holds back a tail that
+// might be the start of secret until it sees more, or until
+// Close.
+type redactor struct {
+	w      io.Writer
+	secret []byte
+	buf    []byte
+}
+
+var redacted = []byte("[redacted]")
+
+func (r *redactor) Write(p []byte) (int, error) {
+	if len(r.secret) == 0 {
+		return r.w.Write(p)
+	}
+	r.buf = bytes.ReplaceAll(append(r.buf, p...), r.secret, redacted)
+	n := len(r.buf)
+	for k := min(len(r.secret)-1, n); k > 0; k-- {
+		if bytes.HasSuffix(r.buf, r.secret[:k]) {
+			n -= k
+			break
+		}
+	}
+	var err error
+	if n > 0 {
+		_, err = r.w.Write(r.buf[:n])
+	}
+	r.buf = append(r.buf[:0], r.buf[n:]...)
+	return len(p), err
+}
+
+// Close writes whatever r has held back.
+func (r *redactor) Close() error {
+	if len(r.buf) == 0 {
+		return nil
+	}
+	_, err := r.w.Write(r.buf)
+	r.buf = nil
+	return err
+}
+
+// A logResponse is a push response that also goes to a
+// build log.
+type logResponse struct {
+	http.ResponseWriter
+	log io.Writer
+}
+
+func (w logResponse) Write(p []byte) (int, error) {
+	w.log.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w logResponse) Flush() {
+	flush(w.ResponseWriter)
+}
+
+var pruneMu sync.Mutex
+
+// pruneLogs removes logs older than logMaxAge.
+func pruneLogs() {
+	if !pruneMu.TryLock() {
+		return // already at it
+	}
+	defer pruneMu.Unlock()
+	cutoff := time.Now().Add(-logMaxAge)
+	dirs, _ := filepath.Glob(filepath.Join(logDir(), "*"))
+	for _, dir := range dirs {
+		paths, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+		left := len(paths)
+		for _, path := range paths {
+			fi, err := os.Stat(path)
+			if err == nil && fi.ModTime().Before(cutoff) && os.Remove(path) == nil {
+				left--
+			}
+		}
+		if left == 0 {
+			os.Remove(dir) // fails harmlessly if a log just appeared
+		}
+	}
+}
+
+// serveLog writes the log for build id of app to w.
+func serveLog(w http.ResponseWriter, r *http.Request, app, id string) error {
+	path := logPath(app, id)
+	if path == "" {
+		http.NotFound(w, r)
+		return nil
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		http.Error(w, "no log for build", 404)
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestRedactor(t *testing.T) {
+	const secret = "s3cr3t"
+	in := []string{"HPUSH_TOKEN=s3", "cr", "3t HPUSH_PIN= exec\n", "s3cr3ts3", "cr3t\n", "tail s3c"}
+	var out bytes.Buffer
+	r := &redactor{w: &out, secret: []byte(secret)}
+	for _, s := range in {
+		if n, err := r.Write([]byte(s)); n != len(s) || err != nil {
+			t.Fatalf("Write(%q) = %d, %v", s, n, err)
+		}
+	}
+	r.Close()
+	want := "HPUSH_TOKEN=[redacted] HPUSH_PIN= exec\n[redacted][redacted]\ntail s3c"
+	if got := out.String(); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if strings.Contains(out.String(), secret) {
+		t.Error("secret leaked")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Builders call back to hpush at connURL. HPUSH_CALLBACK_URL
+// sets it, and baseURL, outright. Otherwise hpush looks for
+// its own address with the detectors named, in order, in
+// HPUSH_DETECT, and uses the first that works.
+var detectors = map[string]func(ctx context.Context) (string, error){
+	"heroku":    detectHeroku,
+	"interface": detectInterface,
+	"ec2":       detectEC2,
+	"gce":       detectGCE,
+}
+
+const (
+	defaultDetect = "heroku,interface"
+	detectTimeout = 2 * time.Second // per detector
+)
+
+// selfHost returns an address for this host that builders
+// can reach, trying each detector in order.
+func selfHost(order string) (string, error) {
+	if order == "" {
+		order = defaultDetect
+	}
+	var errs []string
+	for _, name := range strings.Split(order, ",") {
+		name = strings.TrimSpace(name)
+		f := detectors[name]
+		if f == nil {
+			return "", fmt.Errorf("unknown detector %q", name)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), detectTimeout)
+		host, err := f(ctx)
+		cancel()
+		if err == nil {
+			return host, nil
+		}
+		errs = append(errs, name+": "+err.Error())
+	}
+	return "", errors.New(strings.Join(errs, "; "))
+}
+
+// detectHeroku resolves the dyno's name on the Heroku
+// private network.
+func detectHeroku(ctx context.Context) (string, error) {
+	name, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name+".int.dyno.rt.heroku.com")
+	if err != nil {
+		return "", err
+	}
+	return addrs[0].IP.String(), nil
+}
+
+// detectInterface picks the first IPv4 address of an up,
+// non-loopback interface.
+func detectInterface(ctx context.Context) (string, error) {
+	ifs, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+	for _, ifc := range ifs {
+		if ifc.Flags&net.FlagUp == 0 || ifc.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		addrs, err := ifc.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range addrs {
+			ipn, ok := a.(*net.IPNet)
+			if ok && ipn.IP.To4() != nil && ipn.IP.IsGlobalUnicast() {
+				return ipn.IP.String(), nil
+			}
+		}
+	}
+	return "", errors.New("no usable interface address")
+}
+
+// detectEC2 asks the EC2 instance metadata service (v2)
+// for the instance's private address.
+func detectEC2(ctx context.Context) (string, error) {
+	const base = "http://169.254.169.254/latest"
+	tok, err := metadata(ctx, "PUT", base+"/api/token", "X-aws-ec2-metadata-token-ttl-seconds", "60")
+	if err != nil {
+		return "", err
+	}
+	return metadata(ctx, "GET", base+"/meta-data/local-ipv4", "X-aws-ec2-metadata-token", tok)
+}
+
+// detectGCE asks the GCE metadata server for the address
+// of the instance's first network interface.
+func detectGCE(ctx context.Context) (string, error) {
+	const u = "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/ip"
+	return metadata(ctx, "GET", u, "Metadata-Flavor", "Google")
+}
+
+// metadata makes a request to a cloud metadata service,
+// with one header set, and returns the body.
+func metadata(ctx context.Context, method, url, hk, hv string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set(hk, hv)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		return "", fmt.Errorf("bad status: %s", resp.Status)
+	}
+	b, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(b)), nil
+}
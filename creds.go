@@ -0,0 +1,255 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Deploy tokens look like hpt_<id>_<secret>. Only a hash of
+// the secret is stored; the id lets an admin revoke a token
+// without knowing it.
+const tokenPrefix = "hpt_"
+
+var (
+	errNoKey        = errors.New("no platform key stored for app")
+	errBadToken     = errors.New("invalid deploy token")
+	errTokenExpired = errors.New("deploy token expired")
+	errTokenRevoked = errors.New("deploy token revoked")
+)
+
+// credStore holds platform API keys, sealed with AES-GCM,
+// and the deploy tokens that map to them. It is persisted
+// as a single JSON file, rewritten on every change.
+type credStore struct {
+	path string
+	aead cipher.AEAD
+
+	mu     sync.Mutex
+	Keys   map[string][]byte // app -> sealed platform key
+	Tokens map[string]*token // token id -> token
+}
+
+type token struct {
+	ID      string
+	App     string
+	Hash    string `json:",omitempty"` // hex sha256 of the secret
+	Note    string `json:",omitempty"`
+	Created time.Time
+	Expires time.Time // zero if the token never expires
+	Revoked time.Time // zero if the token is live
+}
+
+// openCredStore loads the store at path, creating an empty
+// one if the file does not exist. secret must be 32 bytes.
+func openCredStore(path string, secret []byte) (*credStore, error) {
+	block, err := aes.NewCipher(secret)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	s := &credStore{
+		path:   path,
+		aead:   aead,
+		Keys:   make(map[string][]byte),
+		Tokens: make(map[string]*token),
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(b, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// parseSecret decodes a 32-byte key given as hex or base64.
+func parseSecret(s string) ([]byte, error) {
+	if b, err := hex.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	if b, err := base64.StdEncoding.DecodeString(s); err == nil && len(b) == 32 {
+		return b, nil
+	}
+	return nil, errors.New("secret key must be 32 bytes, hex or base64 encoded")
+}
+
+// SetKey stores key for app, encrypted at rest.
+func (s *credStore) SetKey(app, key string) error {
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	sealed := s.aead.Seal(nonce, nonce, []byte(key), []byte(app))
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Keys[app] = sealed
+	return s.save()
+}
+
+// DeleteKey removes the key for app. Its tokens stay listed
+// but can no longer be used.
+func (s *credStore) DeleteKey(app string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.Keys, app)
+	return s.save()
+}
+
+func (s *credStore) key(app string) (string, error) {
+	sealed := s.Keys[app]
+	n := s.aead.NonceSize()
+	if len(sealed) < n {
+		return "", errNoKey
+	}
+	b, err := s.aead.Open(nil, sealed[:n], sealed[n:], []byte(app))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// NewToken issues a deploy token for app. If ttl is nonzero,
+// the token expires after that long. The returned string is
+// the only copy of the full token.
+func (s *credStore) NewToken(app, note string, ttl time.Duration) (*token, string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.Keys[app]; !ok {
+		return nil, "", errNoKey
+	}
+	t := &token{
+		ID:      randhex(16),
+		App:     app,
+		Note:    note,
+		Created: time.Now().UTC(),
+	}
+	if ttl > 0 {
+		t.Expires = t.Created.Add(ttl)
+	}
+	secret := randhex(40)
+	t.Hash = sha256hex([]byte(secret))
+	s.Tokens[t.ID] = t
+	if err := s.save(); err != nil {
+		delete(s.Tokens, t.ID)
+		return nil, "", err
+	}
+	return t, tokenPrefix + t.ID + "_" + secret, nil
+}
+
+// Revoke marks the token with the given id as revoked.
+func (s *credStore) Revoke(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.Tokens[id]
+	if t == nil {
+		return errBadToken
+	}
+	if t.Revoked.IsZero() {
+		t.Revoked = time.Now().UTC()
+	}
+	return s.save()
+}
+
+// List returns the tokens issued for app, oldest first,
+// with their hashes removed.
+func (s *credStore) List(app string) []token {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var a []token
+	for _, t := range s.Tokens {
+		if t.App == app {
+			c := *t
+			c.Hash = ""
+			a = append(a, c)
+		}
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Created.Before(a[j].Created) })
+	return a
+}
+
+// Resolve maps deploy token tok to the platform key for app.
+// It also returns the token id, for logging.
+func (s *credStore) Resolve(app, tok string) (key, id string, err error) {
+	parts := strings.SplitN(strings.TrimPrefix(tok, tokenPrefix), "_", 2)
+	if len(parts) != 2 {
+		return "", "", errBadToken
+	}
+	id, secret := parts[0], parts[1]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t := s.Tokens[id]
+	if t == nil || t.App != app {
+		return "", id, errBadToken
+	}
+	h := sha256hex([]byte(secret))
+	if subtle.ConstantTimeCompare([]byte(h), []byte(t.Hash)) != 1 {
+		return "", id, errBadToken
+	}
+	if !t.Revoked.IsZero() {
+		return "", id, errTokenRevoked
+	}
+	if !t.Expires.IsZero() && time.Now().After(t.Expires) {
+		return "", id, errTokenExpired
+	}
+	key, err = s.key(app)
+	return key, id, err
+}
+
+// save must be called with s.mu held.
+func (s *credStore) save() error {
+	b, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, b, 0600)
+}
+
+func writeFileAtomic(name string, b []byte, perm os.FileMode) error {
+	f, err := ioutil.TempFile(filepath.Dir(name), ".tmp")
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(perm)
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), name)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+	return err
+}
+
+func sha256hex(p []byte) string {
+	h := sha256.Sum256(p)
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestStore(t *testing.T, path string) *credStore {
+	s, err := openCredStore(path, bytes.Repeat([]byte{7}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestCredsRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "creds.json")
+	s := openTestStore(t, path)
+	if _, _, err := s.NewToken("a", "", 0); err != errNoKey {
+		t.Fatalf("token without key: err = %v, want %v", err, errNoKey)
+	}
+	if err := s.SetKey("a", "platform-key"); err != nil {
+		t.Fatal(err)
+	}
+	b, _ := os.ReadFile(path)
+	if bytes.Contains(b, []byte("platform-key")) {
+		t.Fatal("key stored in the clear")
+	}
+	_, tok, err := s.NewToken("a", "ci", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key, _, err := s.Resolve("a", tok); err != nil || key != "platform-key" {
+		t.Errorf("Resolve = %q %v, want platform-key", key, err)
+	}
+
+	// reload from disk
+	s = openTestStore(t, path)
+	if key, _, err := s.Resolve("a", tok); err != nil || key != "platform-key" {
+		t.Errorf("after reload: Resolve = %q %v, want platform-key", key, err)
+	}
+	s2, err := openCredStore(path, bytes.Repeat([]byte{8}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s2.Resolve("a", tok); err == nil {
+		t.Error("opened key sealed with another secret")
+	}
+}
+
+// A key sealed for one app must not open as another's.
+func TestCredsSealedPerApp(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "creds.json"))
+	s.SetKey("a", "key-a")
+	s.SetKey("b", "key-b")
+	s.Keys["b"] = s.Keys["a"]
+	if _, err := s.key("b"); err == nil {
+		t.Error("key for a opened as b's")
+	}
+}
+
+func TestCredsBadTokens(t *testing.T) {
+	s := openTestStore(t, filepath.Join(t.TempDir(), "creds.json"))
+	s.SetKey("a", "key-a")
+	s.SetKey("b", "key-b")
+	_, tok, _ := s.NewToken("a", "", 0)
+	if _, _, err := s.Resolve("b", tok); err != errBadToken {
+		t.Errorf("wrong app: err = %v, want %v", err, errBadToken)
+	}
+	if _, _, err := s.Resolve("a", tok+"x"); err != errBadToken {
+		t.Errorf("wrong secret: err = %v, want %v", err, errBadToken)
+	}
+	if _, _, err := s.Resolve("a", "hpt_nope"); err != errBadToken {
+		t.Errorf("malformed: err = %v, want %v", err, errBadToken)
+	}
+
+	rt, tok, _ := s.NewToken("a", "", 0)
+	if err := s.Revoke(rt.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := s.Resolve("a", tok); err != errTokenRevoked {
+		t.Errorf("revoked: err = %v, want %v", err, errTokenRevoked)
+	}
+	if err := s.Revoke("nope"); err != errBadToken {
+		t.Errorf("revoke unknown: err = %v, want %v", err, errBadToken)
+	}
+
+	et, tok, _ := s.NewToken("a", "", time.Hour)
+	et.Expires = time.Now().Add(-time.Minute)
+	if _, _, err := s.Resolve("a", tok); err != errTokenExpired {
+		t.Errorf("expired: err = %v, want %v", err, errTokenExpired)
+	}
+
+	s.DeleteKey("a")
+	_, tok, _ = s.NewToken("b", "", 0)
+	if key, _, err := s.Resolve("b", tok); err != nil || key != "key-b" {
+		t.Errorf("other app after delete: %q %v", key, err)
+	}
+	for _, tk := range s.List("a") {
+		if tk.Hash != "" {
+			t.Error("List leaks token hashes")
+		}
+	}
+}
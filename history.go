@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Every build leaves a buildRecord in the history store,
+// chosen by HPUSH_HISTORY: "file:{path}", "none", or, by
+// default, a file in the data dir. The file holds one JSON
+// record per line, appended as builds finish.
+type historyStore interface {
+	Add(rec *buildRecord) error
+	List(app string, limit int) ([]*buildRecord, error) // newest first
+}
+
+var history historyStore = nopHistory{}
+
+// commitHeader carries the commit being pushed, if the
+// client knows it.
+const commitHeader = "X-Hpush-Commit"
+
+type buildRecord struct {
+	ID         string
+	App        string
+	Requester  string
+	Commit     string `json:",omitempty"`
+	Buildpack  string `json:",omitempty"`
+	Start      time.Time
+	End        time.Time
+	Phases     map[string]time.Duration `json:",omitempty"`
+	State      string
+	Reason     string `json:",omitempty"` // msg.Reason*, if the builder failed
+	SlugSize   int64  `json:",omitempty"`
+	SlugDigest string `json:",omitempty"` // hex sha256
+	Release    string `json:",omitempty"`
+}
+
+func openHistory(spec, dir string) (historyStore, error) {
+	switch {
+	case spec == "":
+		return &fileHistory{path: dir + "/builds.jsonl"}, nil
+	case spec == "none":
+		return nopHistory{}, nil
+	case strings.HasPrefix(spec, "file:"):
+		return &fileHistory{path: strings.TrimPrefix(spec, "file:")}, nil
+	}
+	return nil, fmt.Errorf("unknown history store %q", spec)
+}
+
+type nopHistory struct{}
+
+func (nopHistory) Add(*buildRecord) error                   { return nil }
+func (nopHistory) List(string, int) ([]*buildRecord, error) { return nil, nil }
+
+type fileHistory struct {
+	path string
+	mu   sync.Mutex
+}
+
+func (h *fileHistory) Add(rec *buildRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(b, '\n'))
+	if err1 := f.Close(); err == nil {
+		err = err1
+	}
+	return err
+}
+
+func (h *fileHistory) List(app string, limit int) ([]*buildRecord, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	f, err := os.Open(h.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var a []*buildRecord
+	sc := bufio.NewScanner(f)
+	sc.Buffer(nil, 1<<20)
+	for sc.Scan() {
+		rec := new(buildRecord)
+		if json.Unmarshal(sc.Bytes(), rec) != nil || rec.App != app {
+			continue // skip a line torn by a crash
+		}
+		a = append(a, rec)
+		if limit > 0 && len(a) > limit {
+			a = a[1:]
+		}
+	}
+	if err = sc.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(a)-1; i < j; i, j = i+1, j-1 {
+		a[i], a[j] = a[j], a[i]
+	}
+	return a, nil
+}
+
+// requester says who made push request r, for the record:
+// the basic auth user, or the deploy token's id.
+func requester(r *http.Request) string {
+	user, pass := getBasicAuth(r.Header.Get("Authorization"))
+	if strings.HasPrefix(pass, tokenPrefix) {
+		if f := strings.SplitN(pass, "_", 3); len(f) == 3 {
+			return "token " + f[1]
+		}
+	}
+	return user
+}
+
+// fileDigest returns the hex sha256 of f's contents,
+// leaving f's offset at the start.
+func fileDigest(f *os.File) (string, error) {
+	if _, err := f.Seek(0, 0); err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	_, err := f.Seek(0, 0)
+	return hex.EncodeToString(h.Sum(nil)), err
+}
@@ -1 +1,17 @@
-curl -n -T <(git archive $1) https://hpush.herokuapp.com/push/`hk app`
+url=https://hpush.herokuapp.com
+app=`hk app`
+case "$1" in
+cancel)
+	exec curl -n -X POST $url/apps/$app/builds/$2/cancel
+	;;
+builds)
+	exec curl -n $url/apps/$app/builds
+	;;
+log)
+	exec curl -n $url/apps/$app/builds/$2/log
+	;;
+esac
+q=
+[ -t 1 ] && q=?color=1
+commit=`git rev-parse --verify -q ${1:-HEAD}^{commit}`
+curl -n -H "X-Hpush-Commit: $commit" -T <(git archive $1) $url/push/$app$q
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Each app has a deploy lock, which pushes take in the
+// order they were made. HPUSH_LOCK_SCOPE says what it
+// covers: "release" (the default) lets builds run in
+// parallel but releases them in push order; "build" holds
+// it from build to release. HPUSH_LOCK_MODE says what a
+// push to a locked app does: "queue" (the default) waits
+// its turn, "refuse" fails at once.
+var locks = &deployLocks{
+	scope: "release",
+	mode:  "queue",
+	apps:  make(map[string][]*lockEntry),
+}
+
+var (
+	errLocked     = errors.New("app is locked by another push")
+	errLockBroken = errors.New("deploy lock broken by admin")
+)
+
+type deployLocks struct {
+	scope string
+	mode  string
+
+	mu   sync.Mutex
+	apps map[string][]*lockEntry // in push order; the first holds the lock
+}
+
+// A lockEntry is a push's place in line for its app's lock.
+type lockEntry struct {
+	l     *deployLocks
+	App   string
+	Build string // ID, once the build has started
+	Since time.Time
+	turn  chan struct{}   // closed once e holds the lock
+	ctx   context.Context // done if the lock is broken from e
+	brk   context.CancelCauseFunc
+}
+
+// pushMu makes a push's place in line for the deploy lock
+// agree with its place in the build queue, lest a later
+// push take the last build slot and then wait forever for
+// the lock.
+var pushMu sync.Mutex
+
+// enterPush puts a push to app in line for the deploy lock
+// and the build queue.
+func enterPush(app string) (*lockEntry, *ticket, error) {
+	pushMu.Lock()
+	defer pushMu.Unlock()
+	e, err := locks.enter(app)
+	if err != nil {
+		return nil, nil, err
+	}
+	return e, queue.enter(app), nil
+}
+
+func (l *deployLocks) enter(app string) (*lockEntry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.apps[app]
+	if len(a) > 0 && l.mode == "refuse" {
+		return nil, errLocked
+	}
+	e := &lockEntry{l: l, App: app, Since: time.Now(), turn: make(chan struct{})}
+	e.ctx, e.brk = context.WithCancelCause(context.Background())
+	if len(a) == 0 {
+		close(e.turn)
+	}
+	l.apps[app] = append(a, e)
+	return e, nil
+}
+
+// held reports whether e holds the lock.
+func (e *lockEntry) held() bool {
+	select {
+	case <-e.turn:
+		return e.ctx.Err() == nil
+	default:
+		return false
+	}
+}
+
+// context returns a context derived from parent that is
+// also cancelled, with errLockBroken, if the lock is broken
+// from e.
+func (e *lockEntry) context(parent context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(parent)
+	stop := context.AfterFunc(e.ctx, func() {
+		cancel(context.Cause(e.ctx))
+	})
+	return ctx, func() {
+		stop()
+		cancel(nil)
+	}
+}
+
+func (e *lockEntry) setBuild(id string) {
+	e.l.mu.Lock()
+	e.Build = id
+	e.l.mu.Unlock()
+}
+
+// wait waits for e to hold the lock, telling w who has it.
+// It gives up if hpush is interrupted.
+func (e *lockEntry) wait(ctx context.Context, w io.Writer) error {
+	if e.held() {
+		return nil
+	} else if e.ctx.Err() != nil {
+		return context.Cause(e.ctx)
+	}
+	e.l.mu.Lock()
+	holder := "another push"
+	if a := e.l.apps[e.App]; len(a) > 0 && a[0].Build != "" {
+		holder = "build " + a[0].Build
+	}
+	e.l.mu.Unlock()
+	fprintf(w, "waiting for deploy lock, held by %s\n", holder)
+	select {
+	case <-e.turn:
+		if !e.held() {
+			return context.Cause(e.ctx)
+		}
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	case <-interrupted.Done():
+		return context.Cause(interrupted)
+	}
+}
+
+// done takes e out of line, passing the lock on if e held it.
+func (e *lockEntry) done() {
+	l := e.l
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.remove(e)
+}
+
+// remove must be called with l.mu held.
+func (l *deployLocks) remove(e *lockEntry) {
+	a := l.apps[e.App]
+	for i, f := range a {
+		if f == e {
+			a = append(a[:i], a[i+1:]...)
+			break
+		}
+	}
+	if len(a) == 0 {
+		delete(l.apps, e.App)
+		return
+	}
+	l.apps[e.App] = a
+	if !a[0].held() {
+		close(a[0].turn)
+	}
+}
+
+// A lockStatus describes an app's deploy lock.
+type lockStatus struct {
+	App     string
+	Scope   string
+	Locked  bool
+	Build   string    `json:",omitempty"` // holding the lock
+	Since   time.Time `json:",omitempty"`
+	Waiting int       // pushes in line behind it
+}
+
+func (l *deployLocks) status(app string) lockStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := lockStatus{App: app, Scope: l.scope}
+	if a := l.apps[app]; len(a) > 0 {
+		s.Locked = true
+		s.Build = a[0].Build
+		s.Since = a[0].Since
+		s.Waiting = len(a) - 1
+	}
+	return s
+}
+
+// forceUnlock passes app's lock on from its holder, which
+// fails with errLockBroken, whether or not it has started
+// its build. It returns a copy of the holder's entry, or nil
+// if the app was not locked.
+func (l *deployLocks) forceUnlock(app string) *lockEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	a := l.apps[app]
+	if len(a) == 0 {
+		return nil
+	}
+	e := *a[0]
+	a[0].brk(errLockBroken)
+	l.remove(a[0])
+	return &e
+}
+
+func loadLockConfig(scope, mode string) error {
+	switch scope {
+	case "":
+	case "build", "release":
+		locks.scope = scope
+	default:
+		return fmt.Errorf("HPUSH_LOCK_SCOPE: unknown scope %q", scope)
+	}
+	switch mode {
+	case "":
+	case "queue", "refuse":
+		locks.mode = mode
+	default:
+		return fmt.Errorf("HPUSH_LOCK_MODE: unknown mode %q", mode)
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"io"
+	"testing"
+	"time"
+)
+
+func newLocks(mode string) *deployLocks {
+	return &deployLocks{scope: "release", mode: mode, apps: make(map[string][]*lockEntry)}
+}
+
+// waitAsync runs e.wait in the background.
+func waitAsync(e *lockEntry) <-chan error {
+	c := make(chan error, 1)
+	go func() { c <- e.wait(context.Background(), io.Discard) }()
+	return c
+}
+
+func TestLockQueue(t *testing.T) {
+	l := newLocks("queue")
+	e1, _ := l.enter("a")
+	e2, _ := l.enter("a")
+	e3, _ := l.enter("a")
+	other, _ := l.enter("b")
+	if !e1.held() || e2.held() || e3.held() || !other.held() {
+		t.Fatalf("held = %v %v %v %v, want true false false true", e1.held(), e2.held(), e3.held(), other.held())
+	}
+	w2, w3 := waitAsync(e2), waitAsync(e3)
+	select {
+	case err := <-w2:
+		t.Fatalf("e2 got the lock early: %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	e1.done()
+	if err := <-w2; err != nil {
+		t.Fatal(err)
+	}
+	if e3.held() {
+		t.Fatal("e3 holds the lock along with e2")
+	}
+	e2.done()
+	if err := <-w3; err != nil {
+		t.Fatal(err)
+	}
+	e3.done()
+	if s := l.status("a"); s.Locked {
+		t.Errorf("status = %+v, want unlocked", s)
+	}
+}
+
+func TestLockRefuse(t *testing.T) {
+	l := newLocks("refuse")
+	e1, err := l.enter("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = l.enter("a"); err != errLocked {
+		t.Fatalf("second enter: err = %v, want %v", err, errLocked)
+	}
+	if _, err = l.enter("b"); err != nil {
+		t.Fatalf("other app: %v", err)
+	}
+	e1.done()
+	if _, err = l.enter("a"); err != nil {
+		t.Fatalf("after done: %v", err)
+	}
+}
+
+func TestForceUnlock(t *testing.T) {
+	l := newLocks("queue")
+	if l.forceUnlock("a") != nil {
+		t.Fatal("unlocked an app that was not locked")
+	}
+	e1, _ := l.enter("a") // no build yet
+	e2, _ := l.enter("a")
+	ctx, stop := e1.context(context.Background())
+	defer stop()
+	w2 := waitAsync(e2)
+
+	if e := l.forceUnlock("a"); e == nil || e.Build != "" {
+		t.Fatalf("forceUnlock = %+v", e)
+	}
+	if err := <-w2; err != nil {
+		t.Fatal(err)
+	}
+	if e1.held() || !e2.held() {
+		t.Errorf("held = %v %v, want false true", e1.held(), e2.held())
+	}
+	if err := e1.wait(context.Background(), io.Discard); err != errLockBroken {
+		t.Errorf("broken wait: err = %v, want %v", err, errLockBroken)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+	}
+	if err := context.Cause(ctx); err != errLockBroken {
+		t.Errorf("broken context: cause = %v, want %v", err, errLockBroken)
+	}
+	e1.done() // must not disturb e2
+	if !e2.held() {
+		t.Error("e2 lost the lock")
+	}
+	if s := l.status("a"); !s.Locked || s.Waiting != 0 {
+		t.Errorf("status = %+v, want locked by e2 alone", s)
+	}
+}
+
+func TestLockInterrupted(t *testing.T) {
+	oldDone, oldCancel := interrupted, interrupt
+	defer func() { interrupted, interrupt = oldDone, oldCancel }()
+	interrupted, interrupt = context.WithCancelCause(context.Background())
+
+	l := newLocks("queue")
+	e1, _ := l.enter("a")
+	e2, _ := l.enter("a")
+	w2 := waitAsync(e2)
+	interrupt(errInterrupted)
+	select {
+	case err := <-w2:
+		if err != errInterrupted {
+			t.Errorf("wait = %v, want %v", err, errInterrupted)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter not told of the interrupt")
+	}
+	e2.done()
+	e1.done()
+}
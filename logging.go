@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Logs are structured, and every line about a build has a
+// "build" attribute, its wconn ID, which the builder's own
+// logs carry too. HPUSH_LOG_LEVEL sets the least level
+// logged (debug, info, warn, error; default info), and
+// HPUSH_LOG_FORMAT the format (text, the default, or json).
+func newLogger(w io.Writer, level, format string) (*slog.Logger, error) {
+	opts := new(slog.HandlerOptions)
+	if level != "" {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return nil, fmt.Errorf("HPUSH_LOG_LEVEL: %v", err)
+		}
+		opts.Level = l
+	}
+	switch strings.ToLower(format) {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	}
+	return nil, fmt.Errorf("HPUSH_LOG_FORMAT: unknown format %q", format)
+}
+
+// fatal logs err, as what went wrong, and exits.
+func fatal(what string, err error) {
+	slog.Error(what, "err", err)
+	os.Exit(1)
+}
+
+// buildLogger returns the logger for build id of app.
+func buildLogger(id, app string) *slog.Logger {
+	return slog.With("build", id, "app", app)
+}
+
+const maxLogLine = 4096
+
+// lineLogger returns a writer that logs each line written
+// to it as message m, in attribute "line".
+func lineLogger(l *slog.Logger, m string) io.Writer {
+	return &lineWriter{l: l, m: m}
+}
+
+type lineWriter struct {
+	l   *slog.Logger
+	m   string
+	mu  sync.Mutex
+	buf []byte
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < maxLogLine {
+			break
+		} else if i < 0 {
+			i = len(w.buf) - 1 // log it anyway
+		}
+		w.l.Info(w.m, "line", string(bytes.TrimRight(w.buf[:i+1], "\r\n")))
+		w.buf = w.buf[i+1:]
+	}
+	return len(p), nil
+}
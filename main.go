@@ -9,9 +9,10 @@ package main
 //     - ps launch
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
-	"crypto/sha1"
 	"crypto/tls"
 	"encoding/base64"
 	"encoding/hex"
@@ -21,13 +22,17 @@ import (
 	"github.com/kr/hpush/msg"
 	"io"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 )
@@ -35,6 +40,8 @@ import (
 const (
 	MaxTarSize   = 2 * 1000 * 1000
 	MatchTimeout = 15 * time.Second
+	MaxAuthSkew  = 5 * time.Minute
+	CancelGrace  = 10 * time.Second
 )
 
 var (
@@ -44,41 +51,184 @@ var (
 )
 
 var (
-	apiURL = "https://api.heroku.com"
+	apiURL      = "https://api.heroku.com"
+	idleTimeout = 60 * time.Second // see msg.NewMux
+	localCaps   = []string{msg.CapDeflate}
 )
 
 var (
-	builderPath = mustLookPath("builder")
-	builderBin  = mustReadFile(builderPath)
-	builderSha1 = sha1sum(builderBin)
+	baseURL string // where builders fetch the builder binary
+	connURL string // where builders dial back
+	connPin string // msg.Fingerprint builders expect at connURL, if any
+	curlPin string // curl --pinnedpubkey arg, if baseURL is https
 )
 
 var (
-	tmpDir = os.TempDir()
+	tmpDir  = os.TempDir()
+	dataDir = filepath.Join(tmpDir, "hpush")
+)
+
+var (
+	adminKey string
+	creds    *credStore // nil if HPUSH_SECRET_KEY is unset
 )
 
 func main() {
-	log.SetFlags(log.Lshortfile)
+	logger, err := newLogger(os.Stderr, os.Getenv("HPUSH_LOG_LEVEL"), os.Getenv("HPUSH_LOG_FORMAT"))
+	if err != nil {
+		fatal("logging", err)
+	}
+	slog.SetDefault(logger)
 	if s := os.Getenv("HEROKU_API_URL"); s != "" {
 		apiURL = strings.TrimRight(s, "/")
 	}
-	log.Println("selfURL", selfURL())
+	if s := os.Getenv("HPUSH_DATA_DIR"); s != "" {
+		dataDir = s
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		fatal("data dir", err)
+	}
+	adminKey = os.Getenv("HPUSH_ADMIN_KEY")
+	if os.Getenv("HPUSH_NO_COMPRESS") != "" {
+		localCaps = nil
+	}
+	if s := os.Getenv("HPUSH_IDLE_TIMEOUT"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			fatal("HPUSH_IDLE_TIMEOUT", err)
+		}
+		idleTimeout = d
+	}
+	if s := os.Getenv("HPUSH_SECRET_KEY"); s != "" {
+		secret, err := parseSecret(s)
+		if err != nil {
+			fatal("HPUSH_SECRET_KEY", err)
+		}
+		creds, err = openCredStore(filepath.Join(dataDir, "creds.json"), secret)
+		if err != nil {
+			fatal("creds", err)
+		}
+	}
+	for name, p := range map[string]*int{
+		"HPUSH_MAX_BUILDS":     &queue.max,
+		"HPUSH_MAX_APP_BUILDS": &queue.maxApp,
+	} {
+		if s := os.Getenv(name); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				fatal(name, err)
+			}
+			*p = n
+		}
+	}
+	queue.supersede = os.Getenv("HPUSH_SUPERSEDE") != ""
+	if err := loadLockConfig(os.Getenv("HPUSH_LOCK_SCOPE"), os.Getenv("HPUSH_LOCK_MODE")); err != nil {
+		fatal("lock config", err)
+	}
+	if s := os.Getenv("HPUSH_LOG_MAX_AGE"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			fatal("HPUSH_LOG_MAX_AGE", err)
+		}
+		logMaxAge = d
+	}
+	if s := os.Getenv("HPUSH_LOG_MAX_SIZE"); s != "" {
+		n, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			fatal("HPUSH_LOG_MAX_SIZE", err)
+		}
+		logMaxSize = n
+	}
+	go pruneLogs()
+	if history, err = openHistory(os.Getenv("HPUSH_HISTORY"), dataDir); err != nil {
+		fatal("HPUSH_HISTORY", err)
+	}
+	if err := loadTimeouts(); err != nil {
+		fatal("timeouts", err)
+	}
+	if err := loadBuilders(os.Getenv("HPUSH_BUILDER_DIR")); err != nil {
+		fatal("builders", err)
+	}
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = "8000"
+	}
+	if tlsPort = os.Getenv("HPUSH_TLS_PORT"); tlsPort != "" {
+		err := setupTLS(os.Getenv("HPUSH_TLS_CERT"), os.Getenv("HPUSH_TLS_KEY"))
+		if err != nil {
+			fatal("tls", err)
+		}
+		slog.Info("tls", "pin", tlsPin)
+	}
+	if s := os.Getenv("HPUSH_CALLBACK_URL"); s != "" {
+		// not necessarily us, so no pinning
+		baseURL = strings.TrimRight(s, "/")
+		connURL = baseURL
+	} else {
+		host, err := selfHost(os.Getenv("HPUSH_DETECT"))
+		if err != nil {
+			fatal("can't find own address (set HPUSH_CALLBACK_URL)", err)
+		}
+		baseURL = "http://" + host + ":" + port
+		connURL = baseURL
+		if tlsPort != "" {
+			connURL = "https://" + host + ":" + tlsPort
+			connPin = tlsPin
+			if os.Getenv("HPUSH_BUILDER_HTTPS") != "" {
+				baseURL = connURL
+				curlPin = "-k --pinnedpubkey sha256//" + tlsKeyPin // -k: the pin replaces CA checks
+			}
+		}
+	}
+	slog.Info("self", "url", baseURL, "conn_url", connURL)
+	peerURL = connURL // over TLS if we can, for the build's data
+	if s := os.Getenv("HPUSH_PEER_URL"); s != "" {
+		peerURL = strings.TrimRight(s, "/")
+	}
+	rendezvous, err = openRendezvous(os.Getenv("HPUSH_RENDEZVOUS"))
+	if err != nil {
+		fatal("HPUSH_RENDEZVOUS", err)
+	}
 	go match()
 	handlePrefix("/push/", errHandler{handlePush})
 	handlePrefix("/conn/", errHandler{handleConn})
+	handlePrefix("/admin/", errHandler{handleAdmin})
+	handlePrefix("/apps/", errHandler{handleApps})
 	http.HandleFunc("/builder", handleBuilder)
-	listen := ":" + os.Getenv("PORT")
-	if listen == ":" {
-		listen = ":8000"
+	http.HandleFunc("/builder/", handleBuilder)
+	http.HandleFunc("/metrics", handleMetrics)
+	drainTimeout := defaultDrainTimeout
+	if s := os.Getenv("HPUSH_DRAIN_TIMEOUT"); s != "" {
+		if drainTimeout, err = time.ParseDuration(s); err != nil {
+			fatal("HPUSH_DRAIN_TIMEOUT", err)
+		}
 	}
-	err := http.ListenAndServe(listen, nil)
-	if err != nil {
-		panic(err)
+	srvs := []*http.Server{{Addr: ":" + port}}
+	if tlsPort != "" {
+		srvs = append(srvs, tlsServer(":"+tlsPort, http.DefaultServeMux))
+	}
+	for _, srv := range srvs {
+		go func(srv *http.Server) {
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				fatal("serve", err)
+			}
+		}(srv)
 	}
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+	slog.Info("shutting down", "signal", <-sig)
+	shutdown(srvs, drainTimeout)
 }
 
 func match() {
 	wait := make(map[string]*wconn)
+	used := make(map[string]time.Time) // matched IDs, to spot replays
 	for {
 		select {
 		case wc := <-Waiting:
@@ -86,38 +236,93 @@ func match() {
 		case id := <-Cancel:
 			delete(wait, id)
 		case ic := <-Inbound:
-			if wc := wait[ic.ID]; wc == nil {
+			for id, t := range used {
+				if time.Since(t) > 2*MaxAuthSkew {
+					delete(used, id)
+				}
+			}
+			wc := wait[ic.ID]
+			if wc == nil {
+				if _, ok := used[ic.ID]; ok {
+					slog.Warn("conn replayed", "build", ic.ID, "addr", ic.addr)
+				} else {
+					slog.Warn("conn for unknown build", "build", ic.ID, "addr", ic.addr)
+				}
 				ic.c.Close()
-			} else {
-				delete(wait, ic.ID)
-				wc.c <- ic.c
+				continue
+			}
+			err := msg.CheckAuth(ic.auth, wc.Token, wc.ID, time.Now(), MaxAuthSkew)
+			if err != nil {
+				slog.Warn("conn auth failed", "build", ic.ID, "addr", ic.addr, "err", err)
+				ic.c.Close()
+				continue
 			}
+			delete(wait, ic.ID)
+			used[ic.ID] = time.Now()
+			wc.c <- ic.c
 		}
+		atomic.StoreInt64(&waitingBuilders, int64(len(wait)))
 	}
 }
 
-func handleBuilder(w http.ResponseWriter, r *http.Request) {
-	http.ServeFile(w, r, builderPath)
-}
-
+// handleConn takes a builder's callback. The builder asks
+// to upgrade to msg.UpgradeProto (see msg.Upgrade); peers
+// forwarding a callback send method X and expect no
+// response at all.
 func handleConn(w http.ResponseWriter, r *http.Request) error {
+	upgrade := msg.IsUpgrade(r.Header)
+	if !upgrade && r.Method != "X" {
+		w.Header().Set("Upgrade", msg.UpgradeProto)
+		w.Header().Set("Connection", "Upgrade")
+		http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+		return nil
+	}
 	hj, ok := w.(http.Hijacker)
 	if !ok {
 		return errors.New("web server doesn't support hijacking")
 	}
-	c, _, err := hj.Hijack()
+	c, brw, err := hj.Hijack()
 	if err != nil {
 		return err
 	}
-	Inbound <- &iconn{ID: r.URL.Path, c: c}
+	if brw.Reader.Buffered() > 0 {
+		// the builder may have sent its hello already
+		c = &bufConn{c, brw.Reader}
+	}
+	if upgrade {
+		_, err = io.WriteString(c, msg.UpgradeResponse)
+		if err != nil {
+			c.Close()
+			return nil // too late for an error response
+		}
+	}
+	if routeConn(c, r.URL.Path, r) {
+		return nil
+	}
+	addr := r.RemoteAddr
+	if s := r.Header.Get(forwardedHeader); s != "" {
+		addr = s + " via " + addr
+	}
+	Inbound <- &iconn{
+		ID:   r.URL.Path,
+		c:    c,
+		auth: r.Header.Get(msg.AuthHeader),
+		addr: addr,
+	}
 	return nil
 }
 
 func handlePush(w http.ResponseWriter, r *http.Request) error {
 	app := r.URL.Path
-	_, key := getBasicAuth(r.Header.Get("Authorization"))
-	if key == "" {
-		http.Error(w, "unauthorized", 401)
+	if !beginPush() {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, "hpush is restarting; try again shortly", http.StatusServiceUnavailable)
+		return nil
+	}
+	defer endPush()
+	pushesTotal.inc()
+	key, ok := appKey(w, r, app)
+	if !ok {
 		return nil
 	}
 	if r.ContentLength > MaxTarSize {
@@ -125,56 +330,191 @@ func handlePush(w http.ResponseWriter, r *http.Request) error {
 		return nil
 	}
 
+	lk, t, err := enterPush(app)
+	if err == errLocked {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	}
+	defer t.done()
+	defer lk.done()
+	ctx, stop := lk.context(r.Context())
+	defer stop()
+	var f *os.File
+	lockFirst := locks.scope == "build"
+	queued := !t.admitted() || lockFirst && !lk.held()
+	if queued {
+		// the body must be read before the response starts
+		f, err = spool(http.MaxBytesReader(w, r.Body, MaxTarSize))
+		if err != nil {
+			return fmt.Errorf("spool: %v", err)
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
+		if lockFirst {
+			err = lk.wait(ctx, w)
+		}
+		if err == nil {
+			err = t.wait(ctx, w)
+		}
+		if err != nil {
+			fprintf(w, "gave up waiting: %v\n", err)
+			return nil
+		}
+	}
+
+	err = context.Cause(ctx)
+	if err == nil {
+		// a dyno started now would only be stopped by the drain
+		err = context.Cause(interrupted)
+	}
+	if err != nil && queued {
+		fprintf(w, "gave up: %v\n", err)
+		return nil
+	} else if err == errInterrupted {
+		w.Header().Set("Retry-After", "30")
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return nil
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return nil
+	}
 	wc, err := startBuilder(key, app)
 	if err != nil {
 		return err
 	}
+	b := newBuild(ctx, wc, app, key)
+	state := "failed"
+	defer func() { b.finish(state) }()
+	lk.setBuild(b.ID)
+	w = logResponse{w, b.log}
+	b.record(func(rec *buildRecord) {
+		rec.Requester = requester(r)
+		rec.Commit = r.Header.Get(commitHeader)
+	})
 
-	// while the dyno is spinning up, read the body
-	f, err := spool(http.MaxBytesReader(w, r.Body, MaxTarSize))
-	if err != nil {
-		return fmt.Errorf("spool: %v", err)
+	if !queued {
+		// while the dyno is spinning up, read the body
+		f, err = spool(http.MaxBytesReader(w, r.Body, MaxTarSize))
+		if err != nil {
+			return fmt.Errorf("spool: %v", err)
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusAccepted)
 	}
 	fi, _ := f.Stat()
-
-	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	w.WriteHeader(http.StatusAccepted)
-	fprintf(w, "started build dyno %s\n", wc.psname)
+	fprintf(w, "started build %s on dyno %s\n", b.ID, wc.psname)
+	b.logger.Info("build started", "dyno", wc.psname, "size", fi.Size())
 
 	slugURL := ""
 
-	slug, procfile := waitBuild(w, wc, slugURL, f, fi.Size())
+	color := r.FormValue("color") != ""
+	slug, procfile := waitBuild(b, w, wc, slugURL, f, fi.Size(), color)
+	if b.ctx.Err() != nil {
+		state = "cancelled"
+		if te, ok := b.cause().(*timeoutError); ok {
+			state = "timed out"
+			fprintf(w, "%v\n", te)
+		} else if b.cause() == errInterrupted {
+			state = "interrupted"
+			fprintf(w, "build interrupted: %v; push again\n", errInterrupted)
+		} else {
+			fprintf(w, "build cancelled: %v\n", b.cause())
+		}
+		if err := stopDyno(key, app, wc.psname); err != nil {
+			b.logger.Error("stop dyno", "dyno", wc.psname, "err", err)
+		}
+		return nil
+	}
 	if slug == nil || procfile == nil {
 		fprintf(w, "error\n")
 		return nil
 	}
 	fi, _ = slug.Stat()
 	fprintf(w, "got slug %d bytes\n", fi.Size())
+	slugSize.observe(float64(fi.Size()))
+	digest, err := fileDigest(slug)
+	if err != nil {
+		return err
+	}
+	b.record(func(rec *buildRecord) {
+		rec.SlugSize = fi.Size()
+		rec.SlugDigest = digest
+	})
+	if err = lk.wait(b.ctx, w); err != nil {
+		fprintf(w, "release cancelled: %v\n", err)
+		return nil
+	}
 	fprintf(w, "releasing\n")
-	name, err := release(key, app, slug, fi.Size(), procfile)
+	b.timePhase("release", true)
+	name, err := release(b.ctx, key, app, wc.stack, slug, fi.Size(), procfile)
+	b.timePhase("release", false)
+	b.record(func(rec *buildRecord) { rec.Release = name })
 	if err != nil {
 		fprintf(w, "release err %v\n", err)
 		return nil
 	}
+	state = "succeeded"
 	fprintf(w, "done, release %s\n", name)
 	return nil
 }
 
-func waitBuild(w io.Writer, wc *wconn, slugURL string, bun *os.File, size int64) (slug *os.File, procfile []byte) {
-	defer func() { Cancel <- wc.ID }()
+// appKey returns the platform key to use for app. The basic
+// auth password is either a platform key, used as is, or a
+// deploy token, mapped to the key stored for app. If there
+// is no usable key, appKey writes an error response to w.
+func appKey(w http.ResponseWriter, r *http.Request, app string) (key string, ok bool) {
+	_, pass := getBasicAuth(r.Header.Get("Authorization"))
+	if pass == "" {
+		http.Error(w, "unauthorized", 401)
+		return "", false
+	}
+	if !strings.HasPrefix(pass, tokenPrefix) {
+		return pass, true
+	}
+	if creds == nil {
+		http.Error(w, "deploy tokens not enabled", 401)
+		return "", false
+	}
+	key, id, err := creds.Resolve(app, pass)
+	if err != nil {
+		slog.Warn("token refused", "token", id, "app", app, "err", err)
+		http.Error(w, "unauthorized: "+err.Error(), 401)
+		return "", false
+	}
+	return key, true
+}
+
+func waitBuild(b *build, w io.Writer, wc *wconn, slugURL string, bun *os.File, size int64, color bool) (slug *os.File, procfile []byte) {
+	defer func() {
+		Cancel <- wc.ID
+		if err := rendezvous.Delete(wc.ID); err != nil {
+			b.logger.Error("rendezvous delete", "err", err)
+		}
+	}()
 	//go io.Copy(ioutil.Discard, wc.runConn)
-	go io.Copy(os.Stdout, wc.runConn)
+	// The dyno may echo the trampoline, token and all.
+	dyno := &redactor{w: io.MultiWriter(lineLogger(b.logger, "dyno"), b.log.prefixed("dyno| ")), secret: []byte(wc.Token)}
+	go func() {
+		io.Copy(dyno, wc.runConn)
+		dyno.Close()
+	}()
 	fprintf(w, "waiting for dyno\n")
 	select {
 	case bConn := <-wc.c:
+		dynoStart.since(wc.start)
 		fprintf(w, "connected\n")
 		//wc.runConn.Close()
 		defer bConn.Close()
-		slug, procfile = doBuild(w, bConn, slugURL, bun, size)
+		slug, procfile = doBuild(b, w, bConn, slugURL, bun, size, color)
+	case <-b.ctx.Done():
+		b.logger.Info("cancelled before connect")
 	case <-time.After(MatchTimeout):
+		matchTimeouts.inc()
 		fprintf(w, "timeout\n")
 		//wc.runConn.Close()
-		log.Println("timeout:", wc.ID)
+		b.logger.Warn("builder never called back", "after", MatchTimeout)
 	}
 	return
 }
@@ -200,75 +540,220 @@ func spool(r io.Reader) (f *os.File, err error) {
 }
 
 // Communication with builder proceeds as follows:
-//   1. write slug url
-//   2. write tarball
-//   3. read user messages
-//   4. read status
-//   5. if success:
-//      a. read slug
-//      b. read procfile
-func doBuild(w io.Writer, c net.Conn, slugURL string, bun io.Reader, size int64) (slug *os.File, procfile []byte) {
-	err := msg.Write(c, msg.File, []byte(slugURL))
-	if err != nil {
-		log.Println("msg.Write:", err)
-		fmt.Fprintln(w, "could not write slug url", err)
+//  0. exchange hello; the rest runs on msg.MainChan of a msg.Mux
+//  1. write slug url
+//  2. write tarball
+//  3. read user messages (User, Stderr, Phase, Progress, Warning)
+//  4. read status
+//  5. if success:
+//     a. read slug
+//     b. read procfile
+func doBuild(b *build, w io.Writer, conn net.Conn, slugURL string, bun io.Reader, size int64, color bool) (slug *os.File, procfile []byte) {
+	caps, err := msg.Handshake(conn, localCaps)
+	if err != nil {
+		b.logger.Error("handshake", "err", err)
+		fmt.Fprintln(w, "builder handshake failed:", err)
 		fmt.Fprintln(w, "internal error")
 		return nil, nil
 	}
-	err = msg.CopyN(c, msg.File, bun, size)
+	mux := msg.NewMux(conn, idleTimeout)
+	var mc io.ReadWriter = mux.Channel(msg.MainChan)
+	if msg.HasCap(caps, msg.CapDeflate) {
+		mc = msg.Compress(mc)
+	}
+	r, c := msg.NewReader(mc), msg.NewWriter(mc)
+	done := make(chan struct{})
+	defer close(done)
+	go watchCancel(b, mux, done)
+	c.WriteMsg(msg.File, []byte(slugURL))
+	err = c.CopyN(msg.File, bun, size)
+	if err == nil {
+		err = c.Flush()
+	}
 	if err != nil {
-		log.Println("msg.CopyN:", err)
+		b.logger.Error("send tarball", "err", err)
 		fmt.Fprintln(w, "internal error")
 		return nil, nil
 	}
-	t, m, err := msg.ReadFull(c)
+	t, m, err := r.ReadFull()
 	if err != nil {
-		log.Println("msg.ReadFull:", err)
+		b.logger.Error("read message", "err", err)
 		fmt.Fprintln(w, "internal error")
 		return nil, nil
 	}
 	fprintf(w, "starting build\n")
-	for t == msg.User {
-		w.Write(m)
-		flush(w)
-		t, m, err = msg.ReadFull(c)
-		if err != nil {
-			log.Println("msg.ReadFull:", err)
+	con := &console{w: w, color: color}
+	var phaseTimer *time.Timer
+	defer func() {
+		if phaseTimer != nil {
+			phaseTimer.Stop()
+		}
+	}()
+	for t != msg.Status {
+		if t == msg.Phase {
+			phaseTimer = b.watchPhase(phaseTimer, m)
+			b.notePhase(m)
+		}
+		if err = con.render(t, m); err != nil {
+			b.logger.Error("render", "err", err)
+			fprintf(w, "\ninternal error\n")
+			return nil, nil
+		}
+		t, m, err = r.ReadFull()
+		if err == msg.ErrIdle {
+			b.logger.Warn("builder stopped responding", "err", err)
+			fprintf(w, "\nbuilder stopped responding\n")
+			return nil, nil
+		} else if err != nil {
+			b.logger.Error("read message", "err", err)
 			fprintf(w, "\ninternal error\n")
 			return nil, nil
 		}
 	}
-	if t != msg.Status {
-		log.Println("unexpected msg type", t)
+	res, err := msg.DecodeStatus(m)
+	if err != nil {
+		b.logger.Error("decode status", "err", err)
 		fprintf(w, "\ninternal error\n")
 		return nil, nil
 	}
-	if m[0] == msg.Success {
-		fprintf(w, "build ok\n")
-		r, err1 := msg.ReadFile(c)
+	b.record(func(rec *buildRecord) {
+		rec.Buildpack = res.Buildpack
+		rec.Reason = res.Reason
+	})
+	if res.Code == msg.Success {
+		fprintf(w, "build ok after %v\n", res.Duration.Round(time.Second))
+		f, err1 := r.ReadFile()
 		if err1 != nil {
-			log.Println("msg.ReadFile", err1)
+			b.logger.Error("read slug", "err", err1)
 			fprintf(w, "internal error\n")
 			return nil, nil
 		}
-		slug, err = spool(r)
-		if err != nil {
-			log.Println("spool", err)
+		slug, err = spool(f)
+		if err == msg.ErrChecksum || err == msg.ErrTruncated {
+			b.logger.Error("slug transfer", "err", err)
+			fprintf(w, "slug transfer failed: %v\n", err)
+			return nil, nil
+		} else if err != nil {
+			b.logger.Error("spool slug", "err", err)
 			fprintf(w, "internal error\n")
 			return nil, nil
 		}
-		t, procfile, err = msg.ReadFull(c)
+		t, procfile, err = r.ReadFull()
+		if err != nil {
+			b.logger.Error("read procfile", "err", err)
+			fprintf(w, "procfile transfer failed: %v\n", err)
+			return nil, nil
+		}
 		if t != msg.File {
-			log.Printf("expected file, got %d", t)
+			b.logger.Error("expected file", "type", t)
 			fprintf(w, "internal error\n")
 			return nil, nil
 		}
 	} else {
-		fprintf(w, "\nbuild failed\n")
+		b.logger.Info("build failed", "reason", res.Reason, "phase", res.Phase,
+			"exit", res.ExitCode, "duration", res.Duration)
+		fprintf(w, "\n%s\n", describeFailure(res))
 	}
 	return slug, procfile
 }
 
+// watchCancel asks the builder to stop when b is cancelled.
+// If the builder hasn't wound up within CancelGrace, it
+// closes the connection.
+func watchCancel(b *build, mux *msg.Mux, done chan struct{}) {
+	select {
+	case <-b.ctx.Done():
+	case <-done:
+		return
+	}
+	reason := b.cause().Error()
+	err := msg.Write(mux.Channel(msg.ControlChan), msg.Cancel, []byte(reason))
+	if err != nil {
+		b.logger.Error("send cancel", "err", err)
+	}
+	select {
+	case <-done:
+	case <-time.After(CancelGrace):
+		mux.Close()
+	}
+}
+
+// describeFailure says what went wrong, for example
+// "compile failed with exit 1 after 1m33s (compile)".
+func describeFailure(res msg.Result) string {
+	s := "build failed"
+	if res.Phase != "" {
+		s = res.Phase + " failed"
+	}
+	if res.Reason == msg.ReasonTimeout {
+		s = res.Phase + " timed out"
+	}
+	if res.ExitCode != 0 {
+		s += fmt.Sprintf(" with exit %d", res.ExitCode)
+	}
+	s += fmt.Sprintf(" after %v", res.Duration.Round(time.Second)) // of the whole build
+	if res.Reason != "" {
+		s += " (" + res.Reason + ")"
+	}
+	return s
+}
+
+// A console renders builder messages for the person pushing.
+type console struct {
+	w     io.Writer
+	color bool // use ANSI colors
+}
+
+const (
+	ansiRed    = "\033[31m"
+	ansiYellow = "\033[33m"
+	ansiBold   = "\033[1m"
+	ansiReset  = "\033[0m"
+)
+
+func (c *console) render(t byte, p []byte) error {
+	switch t {
+	case msg.User:
+		c.w.Write(p)
+	case msg.Stderr:
+		c.paint(ansiRed, string(p))
+	case msg.Warning:
+		c.paint(ansiYellow, " !     "+string(p))
+	case msg.Phase:
+		name, start, err := msg.DecodePhase(p)
+		if err != nil {
+			return err
+		}
+		if start {
+			c.paint(ansiBold, "-----> "+name+"\n")
+		} else {
+			fmt.Fprintf(c.w, "       %s done\n", name)
+		}
+	case msg.Progress:
+		name, done, total, err := msg.DecodeProgress(p)
+		if err != nil {
+			return err
+		}
+		if total > 0 {
+			fmt.Fprintf(c.w, "       %s: %d/%d (%d%%)\n", name, done, total, done*100/total)
+		} else {
+			fmt.Fprintf(c.w, "       %s: %d\n", name, done)
+		}
+	default:
+		return fmt.Errorf("unexpected msg type %d", t)
+	}
+	flush(c.w)
+	return nil
+}
+
+func (c *console) paint(color, s string) {
+	if c.color {
+		t := strings.TrimSuffix(s, "\n")
+		s = color + t + ansiReset + s[len(t):]
+	}
+	io.WriteString(c.w, s)
+}
+
 func fprintf(w io.Writer, format string, v ...interface{}) {
 	fmt.Fprintf(w, format, v...)
 	flush(w)
@@ -282,63 +767,122 @@ func flush(w io.Writer) {
 
 var trampoline = template.Must(template.New("top").Parse(`
 set -e
-curl -s -o/tmp/builder ` + selfURL() + `/builder
-printf "%s  %s" ` + builderSha1 + ` /tmp/builder >/tmp/sha1
-sha1sum --status -c /tmp/sha1
+case "$(uname -s)/$(uname -m)" in
+{{range .Builders}}{{.Uname}}) sum={{.Sum}} ;;
+{{end}}*) echo "no builder for $(uname -s)/$(uname -m) on {{.Stack}}" >&2; exit 1 ;;
+esac
+curl -s {{.CurlPin}} -o/tmp/builder {{.BaseURL}}/builder/$sum
+printf "%s  %s" $sum /tmp/builder >/tmp/sha256
+sha256sum --status -c /tmp/sha256
 chmod +x /tmp/builder
-exec /tmp/builder ` + selfURL() + `/conn/{{.ID}}
+HPUSH_BUILD_ID={{.ID}} HPUSH_TOKEN={{.Token}} HPUSH_PIN={{.Pin}} HPUSH_IDLE_TIMEOUT={{.Idle}} HPUSH_TIMEOUTS={{.Timeouts}} exec /tmp/builder {{.ConnURL}}/conn/{{.ID}}
 `))
 
+type trampolineArgs struct {
+	*wconn
+	BaseURL  string
+	ConnURL  string
+	Pin      string // fingerprint of our TLS cert, if any
+	CurlPin  string
+	Stack    string
+	Builders []*builderBin
+	Idle     time.Duration
+	Timeouts string // see builderTimeouts
+}
+
 func startBuilder(key, app string) (wc *wconn, err error) {
-	fmt.Println("starting builder for", app)
-	name, runConn, err := psrun(key, app, "/bin/bash # app build")
+	id := randhex(20)
+	l := buildLogger(id, app)
+	l.Debug("starting builder")
+	stack, err := appStack(key, app)
+	if err != nil {
+		l.Warn("no stack, using generic builder", "err", err)
+	}
+	start := time.Now()
+	name, runConn, err := psrun(l, key, app, "/bin/bash # app build")
 	if err != nil {
 		return nil, fmt.Errorf("psrun: %v", err)
 	}
-	fmt.Println("started", name)
+	l.Debug("started dyno", "dyno", name)
 	wc = &wconn{
-		ID:      randhex(20),
+		ID:      id,
+		Token:   randhex(40),
 		c:       make(chan net.Conn, 1),
 		psname:  name,
+		stack:   stack,
 		runConn: runConn,
+		start:   start,
+		logger:  l,
+	}
+	if err = rendezvous.Put(wc.ID, peerURL, rendezvousTTL); err != nil {
+		if err1 := stopDyno(key, app, name); err1 != nil {
+			l.Error("stop dyno", "dyno", name, "err", err1)
+		}
+		runConn.Close()
+		return nil, fmt.Errorf("rendezvous: %v", err)
 	}
-	fmt.Println("sending wc")
 	Waiting <- wc
-	fmt.Println("writing trampoline")
-	if err = trampoline.Execute(runConn, wc); err != nil {
+	l.Debug("writing trampoline")
+	args := trampolineArgs{
+		wconn:    wc,
+		BaseURL:  baseURL,
+		ConnURL:  connURL,
+		Pin:      connPin,
+		CurlPin:  curlPin,
+		Stack:    stack,
+		Builders: buildersFor(stack),
+		Idle:     idleTimeout,
+		Timeouts: builderTimeouts(),
+	}
+	if err = trampoline.Execute(runConn, args); err != nil {
 		return nil, err
 	}
 	return wc, nil
 }
 
-func psrun(key, app, cmd string) (name string, c net.Conn, err error) {
+func psrun(l *slog.Logger, key, app, cmd string) (name string, c net.Conn, err error) {
 	var x struct {
 		Name string
 		URL  string `json:"attach_url"`
 	}
-	fmt.Println("psrun: post", app)
-	err = apiPost(&x, key, "/apps/"+app+"/dynos", "", map[string]interface{}{
+	l.Debug("psrun: post")
+	err = apiPost(context.Background(), &x, key, "/apps/"+app+"/dynos", "", map[string]interface{}{
 		"command": cmd,
 		"attach":  true,
 	})
 	if err != nil {
 		return "", nil, fmt.Errorf("api: %v", err)
 	}
-	fmt.Println("psrun: got resp")
-	c, err = rendez(x.URL)
+	l.Debug("psrun: got resp", "dyno", x.Name)
+	c, err = rendez(l, x.URL)
 	return x.Name, c, err
 }
 
-func release(key, app string, slug *os.File, size int64, procfile []byte) (name string, err error) {
+// release uploads slug and releases it on stack, or on cedar
+// if stack is unknown.
+func release(ctx context.Context, key, app, stack string, slug *os.File, size int64, procfile []byte) (name string, err error) {
+	if stack == "" {
+		stack = "cedar"
+	}
+	// Each API call gets the release timeout to itself, so
+	// the upload between them doesn't use it up.
+	rctx, cancel := withPhaseTimeout(ctx, "release")
+	defer cancel()
 	var x struct{ Slug_put_url, Slug_put_key string }
-	err = apiGet(&x, key, "/apps/"+app+"/releases/new", "application/json")
+	t := time.Now()
+	err = apiGet(rctx, &x, key, "/apps/"+app+"/releases/new", "application/json")
+	releaseAPI.since(t)
 	if err != nil {
-		return "", fmt.Errorf("api: %v: %s", err, "/apps/"+app+"/releases/new")
+		return "", fmt.Errorf("api: %v: %s", phaseErr(rctx, err), "/apps/"+app+"/releases/new")
 	}
 
-	resp, err := put(x.Slug_put_url, slug, size)
+	uctx, cancel := withPhaseTimeout(ctx, "upload")
+	defer cancel()
+	t = time.Now()
+	resp, err := put(uctx, x.Slug_put_url, slug, size)
+	uploadTime.since(t)
 	if err != nil {
-		return "", fmt.Errorf("put: %v", err)
+		return "", fmt.Errorf("put: %v", phaseErr(uctx, err))
 	}
 	resp.Body.Close()
 	if resp.StatusCode/100 != 2 { // 200, 201, 202, etc
@@ -351,19 +895,23 @@ func release(key, app string, slug *os.File, size int64, procfile []byte) (name
 		"release_descr": "the desc",
 		"head":          "foo", // what is this?
 		//"config_vars":   map[string]string{},
-		"addons":        []string{},
-		"language_pack": "unknown",
+		"addons":           []string{},
+		"language_pack":    "unknown",
 		"run_deploy_hooks": true,
-		"slug_version":  2,
-		"stack":         "cedar",
+		"slug_version":     2,
+		"stack":            stack,
 	}
 	var rresp struct {
 		Release string
 	}
 	const jtype = "application/json"
-	err = apiPost(&rresp, key, "/apps/"+app+"/releases", jtype, rel)
+	rctx, cancel = withPhaseTimeout(ctx, "release")
+	defer cancel()
+	t = time.Now()
+	err = apiPost(rctx, &rresp, key, "/apps/"+app+"/releases", jtype, rel)
+	releaseAPI.since(t)
 	if err != nil {
-		err = fmt.Errorf("api: %v: %s", err, "/apps/"+app+"/releases")
+		err = fmt.Errorf("api: %v: %s", phaseErr(rctx, err), "/apps/"+app+"/releases")
 	}
 	name = rresp.Release
 	return
@@ -381,8 +929,8 @@ func parseProcfile(b []byte) map[string]string {
 	return m
 }
 
-func put(url string, body io.Reader, size int64) (resp *http.Response, err error) {
-	req, err := http.NewRequest("PUT", url, body)
+func put(ctx context.Context, url string, body io.Reader, size int64) (resp *http.Response, err error) {
+	req, err := http.NewRequestWithContext(ctx, "PUT", url, body)
 	req.ContentLength = size
 	if err != nil {
 		return nil, err
@@ -390,8 +938,8 @@ func put(url string, body io.Reader, size int64) (resp *http.Response, err error
 	return http.DefaultClient.Do(req)
 }
 
-func apiGet(v interface{}, key, path, acc string) error {
-	req, err := http.NewRequest("GET", apiURL+path, nil)
+func apiGet(ctx context.Context, v interface{}, key, path, acc string) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", apiURL+path, nil)
 	if err != nil {
 		return err
 	}
@@ -413,12 +961,12 @@ func apiGet(v interface{}, key, path, acc string) error {
 	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func apiPost(v interface{}, key, path, acc string, x interface{}) error {
+func apiPost(ctx context.Context, v interface{}, key, path, acc string, x interface{}) error {
 	b, err := json.Marshal(x)
 	if err != nil {
 		return err
 	}
-	req, err := http.NewRequest("POST", apiURL+path, bytes.NewReader(b))
+	req, err := http.NewRequestWithContext(ctx, "POST", apiURL+path, bytes.NewReader(b))
 	if err != nil {
 		return err
 	}
@@ -440,29 +988,27 @@ func apiPost(v interface{}, key, path, acc string, x interface{}) error {
 	return json.NewDecoder(resp.Body).Decode(v)
 }
 
-func rendez(u string) (c net.Conn, err error) {
+func rendez(l *slog.Logger, u string) (c net.Conn, err error) {
 	up, err := url.Parse(u)
 	if err != nil {
 		return nil, fmt.Errorf("url: %v: %s", err, u)
 	}
-	fmt.Println("rendez dial")
+	l.Debug("rendez dial", "host", up.Host)
 	c, err = tls.Dial("tcp", up.Host, nil)
 	if err != nil {
 		return nil, err
 	}
-	fmt.Println("rendez send conn str")
 	_, err = io.WriteString(c, up.Path[1:]+"\r\n")
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
-	fmt.Println("rendez read line")
 	err = readline(c)
 	if err != nil {
 		c.Close()
 		return nil, err
 	}
-	fmt.Println("rendez ok")
+	l.Debug("rendez ok")
 	return c, nil
 }
 
@@ -482,18 +1028,6 @@ func getBasicAuth(h string) (u, p string) {
 	return a[0], a[1]
 }
 
-func selfURL() string {
-	name, err := os.Hostname()
-	if err != nil {
-		panic(err)
-	}
-	addrs, err := net.LookupIP(name + ".int.dyno.rt.heroku.com")
-	if err != nil {
-		panic(err)
-	}
-	return "http://" + addrs[0].String() + ":" + os.Getenv("PORT")
-}
-
 func readline(r io.Reader) error {
 	b := make([]byte, 1)
 	for b[0] != '\n' {
@@ -516,14 +1050,34 @@ func randhex(c int) string {
 
 type wconn struct {
 	ID      string
+	Token   string // one-time secret the builder signs its callback with
 	c       chan net.Conn
 	psname  string
+	stack   string // the app's stack, empty if unknown
 	runConn net.Conn
+	start   time.Time // when the dyno was requested
+	logger  *slog.Logger
+}
+
+// bufConn is a net.Conn whose first reads come from r,
+// which holds data read ahead of the hijacked request.
+type bufConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufConn) Read(p []byte) (int, error) {
+	if c.r.Buffered() > 0 {
+		return c.r.Read(p)
+	}
+	return c.Conn.Read(p)
 }
 
 type iconn struct {
-	ID string
-	c  net.Conn
+	ID   string
+	c    net.Conn
+	auth string // value of msg.AuthHeader
+	addr string
 }
 
 type errHandler struct {
@@ -533,7 +1087,7 @@ type errHandler struct {
 func (h errHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	err := h.f(w, r)
 	if err != nil {
-		log.Println(err)
+		slog.Error("request failed", "path", r.URL.Path, "err", err)
 		http.Error(w, "internal error", 500)
 		io.WriteString(w, err.Error())
 	}
@@ -542,25 +1096,3 @@ func (h errHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func handlePrefix(s string, h http.Handler) {
 	http.Handle(s, http.StripPrefix(s, h))
 }
-
-func mustLookPath(name string) string {
-	path, err := exec.LookPath(name)
-	if err != nil {
-		panic(err)
-	}
-	return path
-}
-
-func mustReadFile(filename string) []byte {
-	b, err := ioutil.ReadFile(filename)
-	if err != nil {
-		panic(err)
-	}
-	return b
-}
-
-func sha1sum(p []byte) string {
-	h := sha1.New()
-	h.Write(p)
-	return hex.EncodeToString(h.Sum(nil))
-}
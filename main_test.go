@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/kr/hpush/msg"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// wsProxy returns a reverse proxy to backend that, like many
+// real ones, knows WebSocket. It tunnels other upgrades
+// blindly, but after a WebSocket handshake it passes on
+// only well-formed, masked client frames, and drops the
+// connection at the first bad one.
+func wsProxy(backend string) *httptest.Server {
+	bu, _ := url.Parse(backend)
+	rp := httputil.NewSingleHostReverseProxy(bu)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+			rp.ServeHTTP(w, r)
+			return
+		}
+		bc, err := net.Dial("tcp", bu.Host)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer bc.Close()
+		if err = r.Write(bc); err != nil {
+			return
+		}
+		br := bufio.NewReader(bc)
+		resp, err := http.ReadResponse(br, r)
+		if err != nil {
+			return
+		}
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		fmt.Fprintf(c, "HTTP/1.1 %s\r\n", resp.Status)
+		resp.Header.Write(c)
+		io.WriteString(c, "\r\n")
+		if resp.StatusCode != http.StatusSwitchingProtocols {
+			return
+		}
+		go io.Copy(c, br)
+		for copyFrame(bc, brw.Reader) == nil {
+		}
+	}))
+}
+
+// copyFrame copies one WebSocket frame from a client, or
+// fails if it isn't a valid, masked frame.
+func copyFrame(w io.Writer, r *bufio.Reader) error {
+	h := make([]byte, 2, 14)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return err
+	}
+	op := h[0] & 0x0f
+	if h[0]&0x70 != 0 || op > 2 && op < 8 || op > 10 || h[1]&0x80 == 0 {
+		return fmt.Errorf("bad frame header %x", h)
+	}
+	ext := map[byte]int{126: 2, 127: 8}[h[1]&0x7f]
+	h = h[:2+ext+4] // extended length, mask key
+	if _, err := io.ReadFull(r, h[2:]); err != nil {
+		return err
+	}
+	n := uint64(h[1] & 0x7f)
+	if ext > 0 {
+		n = 0
+		for _, b := range h[2 : 2+ext] {
+			n = n<<8 | uint64(b)
+		}
+	}
+	if _, err := w.Write(h); err != nil {
+		return err
+	}
+	_, err := io.CopyN(w, r, int64(n))
+	return err
+}
+
+// A builder's callback must get through a reverse proxy that
+// checks WebSocket framing, and the connection must carry
+// bytes both ways afterward.
+func TestConnThroughProxy(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/conn/", http.StripPrefix("/conn/", errHandler{handleConn}))
+	backend := httptest.NewServer(mux)
+	defer backend.Close()
+	proxy := wsProxy(backend.URL)
+	defer proxy.Close()
+
+	u, _ := url.Parse(proxy.URL + "/conn/b1")
+	conn, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	done := make(chan error, 1)
+	go func() { done <- msg.Upgrade(conn, u, "sig") }()
+
+	var ic *iconn
+	select {
+	case ic = <-Inbound:
+	case <-time.After(5 * time.Second):
+		t.Fatal("no inbound conn")
+	}
+	defer ic.c.Close()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	if ic.ID != "b1" || ic.auth != "sig" {
+		t.Errorf("iconn = %q %q, want b1 sig", ic.ID, ic.auth)
+	}
+	ic.c.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go io.WriteString(conn, "hello")
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(ic.c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("to hpush: %q %v", b, err)
+	}
+	go io.WriteString(ic.c, "world")
+	if _, err = io.ReadFull(conn, b); err != nil || string(b) != "world" {
+		t.Fatalf("to builder: %q %v", b, err)
+	}
+}
+
+// The same msg frames after a WebSocket handshake don't get
+// through, which is why the callback doesn't claim to be one.
+func TestWSProxyChecksFrames(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		io.WriteString(c, "HTTP/1.1 101 Switching Protocols\r\n"+
+			"Upgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		io.Copy(c, brw)
+	}))
+	defer backend.Close()
+	proxy := wsProxy(backend.URL)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", strings.TrimPrefix(proxy.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: x\r\n"+
+		"Connection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("handshake: %v %v", resp, err)
+	}
+
+	// a masked text frame "hi" is echoed
+	io.WriteString(conn, "\x81\x82\x00\x00\x00\x00hi")
+	b := make([]byte, 8)
+	if _, err = io.ReadFull(br, b); err != nil || string(b[6:]) != "hi" {
+		t.Fatalf("frame: %q %v", b, err)
+	}
+	msg.Write(conn, msg.User, []byte("hello"))
+	if p, err := io.ReadAll(br); len(p) > 0 || err != nil {
+		t.Errorf("after msg frame: %q %v, want connection dropped", p, err)
+	}
+}
+
+func TestConnNotUpgrade(t *testing.T) {
+	r := httptest.NewRequest("GET", "/b1", nil)
+	w := httptest.NewRecorder()
+	errHandler{handleConn}.ServeHTTP(w, r)
+	if w.Code != http.StatusUpgradeRequired || w.Header().Get("Upgrade") != msg.UpgradeProto {
+		t.Errorf("plain GET: %d, Upgrade %q", w.Code, w.Header().Get("Upgrade"))
+	}
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	w = httptest.NewRecorder()
+	errHandler{handleConn}.ServeHTTP(w, r)
+	if w.Code != http.StatusUpgradeRequired {
+		t.Errorf("websocket upgrade: %d, want 426", w.Code)
+	}
+}
+
+// A slow upload mustn't count against the release timeout.
+// The release is on the app's own stack.
+func TestReleaseSlowUpload(t *testing.T) {
+	var rel struct{ Stack string }
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method + " " + r.URL.Path {
+		case "GET /apps/app1/releases/new":
+			io.WriteString(w, `{"slug_put_url":"`+srv.URL+`/slug","slug_put_key":"k"}`)
+		case "PUT /slug":
+			io.Copy(io.Discard, r.Body)
+			time.Sleep(300 * time.Millisecond)
+		case "POST /apps/app1/releases":
+			json.NewDecoder(r.Body).Decode(&rel)
+			io.WriteString(w, `{"release":"v2"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	oldURL, oldRelease, oldUpload := apiURL, timeouts["release"], timeouts["upload"]
+	defer func() {
+		apiURL, timeouts["release"], timeouts["upload"] = oldURL, oldRelease, oldUpload
+	}()
+	apiURL = srv.URL
+	timeouts["release"] = 100 * time.Millisecond
+	timeouts["upload"] = 5 * time.Second
+
+	slug, err := os.CreateTemp(t.TempDir(), "slug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer slug.Close()
+	io.WriteString(slug, "slug")
+	slug.Seek(0, 0)
+	name, err := release(context.Background(), "good", "app1", "heroku-22", slug, 4, []byte("web: x\n"))
+	if err != nil || name != "v2" {
+		t.Fatalf("release = %q, %v; want v2", name, err)
+	}
+	if rel.Stack != "heroku-22" {
+		t.Errorf("released on stack %q, want heroku-22", rel.Stack)
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics, served at /metrics in the Prometheus text format.
+var (
+	pushesTotal   = newCounter("hpush_pushes_total", "Pushes received.")
+	buildsTotal   = newCounter("hpush_builds_total", "Builds finished, by state and failure reason.", "state", "reason")
+	matchTimeouts = newCounter("hpush_match_timeouts_total", "Builders that never called back.")
+
+	dynoStart   = newHistogram("hpush_dyno_start_seconds", "Time from requesting a build dyno to its builder connecting.", timeBuckets)
+	compileTime = newHistogram("hpush_compile_seconds", "Duration of the compile phase.", timeBuckets)
+	slugSize    = newHistogram("hpush_slug_size_bytes", "Size of built slugs.", sizeBuckets)
+	uploadTime  = newHistogram("hpush_upload_seconds", "Time to upload a slug.", timeBuckets)
+	releaseAPI  = newHistogram("hpush_release_api_seconds", "Latency of platform API calls made to release.", apiBuckets)
+)
+
+func init() {
+	newGauge("hpush_waiting_builders", "Builders not yet matched with their callback.", func() float64 {
+		return float64(atomic.LoadInt64(&waitingBuilders))
+	})
+	newGauge("hpush_builds_in_flight", "Builds running.", func() float64 {
+		builds.Lock()
+		defer builds.Unlock()
+		return float64(len(builds.m))
+	})
+}
+
+var (
+	timeBuckets = []float64{1, 2.5, 5, 10, 20, 30, 60, 120, 300, 600, 1200}
+	sizeBuckets = []float64{1 << 20, 10 << 20, 50 << 20, 100 << 20, 200 << 20, 300 << 20, 500 << 20}
+	apiBuckets  = []float64{.05, .1, .25, .5, 1, 2.5, 5, 10}
+)
+
+// waitingBuilders is kept up to date by match.
+var waitingBuilders int64
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var metrics []metric
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, m := range metrics {
+		m.write(w)
+	}
+}
+
+type counter struct {
+	name, help string
+	labels     []string
+
+	mu sync.Mutex
+	m  map[string]float64 // label values, joined by \xff
+}
+
+func newCounter(name, help string, labels ...string) *counter {
+	c := &counter{name: name, help: help, labels: labels, m: make(map[string]float64)}
+	metrics = append(metrics, c)
+	return c
+}
+
+// inc adds one to the count for the label values v.
+func (c *counter) inc(v ...string) {
+	c.mu.Lock()
+	c.m[strings.Join(v, "\xff")]++
+	c.mu.Unlock()
+}
+
+func (c *counter) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.labels) == 0 {
+		fmt.Fprintf(w, "%s %v\n", c.name, c.m[""])
+		return
+	}
+	var keys []string
+	for k := range c.m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s} %v\n", c.name, labelPairs(c.labels, strings.Split(k, "\xff")), c.m[k])
+	}
+}
+
+func labelPairs(names, values []string) string {
+	var a []string
+	for i, n := range names {
+		v := ""
+		if i < len(values) {
+			v = values[i]
+		}
+		a = append(a, fmt.Sprintf("%s=%q", n, v))
+	}
+	return strings.Join(a, ",")
+}
+
+type histogram struct {
+	name, help string
+	buckets    []float64 // upper bounds, ascending
+
+	mu     sync.Mutex
+	counts []uint64 // per bucket, not cumulative
+	sum    float64
+	n      uint64
+}
+
+func newHistogram(name, help string, buckets []float64) *histogram {
+	h := &histogram{name: name, help: help, buckets: buckets, counts: make([]uint64, len(buckets))}
+	metrics = append(metrics, h)
+	return h
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.n++
+}
+
+// since observes the time since t, in seconds.
+func (h *histogram) since(t time.Time) {
+	h.observe(time.Since(t).Seconds())
+}
+
+func (h *histogram) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var cum uint64
+	for i, b := range h.buckets {
+		cum += h.counts[i]
+		fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", h.name, b, cum)
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", h.name, h.n)
+	fmt.Fprintf(w, "%s_sum %v\n%s_count %d\n", h.name, h.sum, h.name, h.n)
+}
+
+type gauge struct {
+	name, help string
+	f          func() float64
+}
+
+func newGauge(name, help string, f func() float64) {
+	metrics = append(metrics, &gauge{name, help, f})
+}
+
+func (g *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %v\n", g.name, g.help, g.name, g.name, g.f())
+}
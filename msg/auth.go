@@ -0,0 +1,89 @@
+package msg
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// AuthHeader is the header a builder sends on its callback
+// connection to prove it was started by hpush for this build.
+const AuthHeader = "X-Hpush-Auth"
+
+var (
+	ErrAuthMissing = errors.New("missing auth")
+	ErrAuthBad     = errors.New("bad auth")
+	ErrAuthStale   = errors.New("stale auth")
+	ErrPinMismatch = errors.New("certificate does not match pin")
+)
+
+// Auth returns the value of AuthHeader for build id at time t,
+// signed with the build's one-time token.
+func Auth(token, id string, t time.Time) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+	return ts + " " + authMAC(token, id, ts)
+}
+
+// CheckAuth verifies header value v for build id, signed with
+// token. The timestamp must be within skew of now.
+func CheckAuth(v, token, id string, now time.Time, skew time.Duration) error {
+	if v == "" {
+		return ErrAuthMissing
+	}
+	f := strings.Fields(v)
+	if len(f) != 2 {
+		return ErrAuthBad
+	}
+	want := authMAC(token, id, f[0])
+	if !hmac.Equal([]byte(f[1]), []byte(want)) {
+		return ErrAuthBad
+	}
+	sec, err := strconv.ParseInt(f[0], 10, 64)
+	if err != nil {
+		return ErrAuthBad
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > skew || d < -skew {
+		return ErrAuthStale
+	}
+	return nil
+}
+
+func authMAC(token, id, ts string) string {
+	h := hmac.New(sha256.New, []byte(token))
+	h.Write([]byte(id + "\n" + ts))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Fingerprint returns the hex SHA-256 digest of a DER-encoded
+// certificate, as used to pin hpush's TLS certificate.
+func Fingerprint(der []byte) string {
+	h := sha256.Sum256(der)
+	return hex.EncodeToString(h[:])
+}
+
+// PinnedTLSConfig returns a TLS client config that accepts
+// only a peer certificate with fingerprint pin. If pin is
+// empty, the usual chain verification applies.
+func PinnedTLSConfig(pin string) *tls.Config {
+	if pin == "" {
+		return &tls.Config{}
+	}
+	return &tls.Config{
+		InsecureSkipVerify: true, // replaced by the pin check
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return ErrPinMismatch
+			}
+			if !hmac.Equal([]byte(Fingerprint(raw[0])), []byte(pin)) {
+				return ErrPinMismatch
+			}
+			return nil
+		},
+	}
+}
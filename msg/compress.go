@@ -0,0 +1,100 @@
+package msg
+
+import (
+	"compress/flate"
+	"io"
+)
+
+// CapDeflate is the Hello capability for compressing the
+// main channel with DEFLATE, in both directions. Contents
+// sent with Writer.CopyNRaw, such as the already gzipped
+// slug, are passed through as they are.
+const CapDeflate = "deflate"
+
+// HasCap reports whether caps includes c.
+func HasCap(caps []string, c string) bool {
+	for _, s := range caps {
+		if s == c {
+			return true
+		}
+	}
+	return false
+}
+
+type compressor struct {
+	w     *flate.Writer
+	dst   io.Writer
+	reset bool // w must forget its history; see Raw
+	buf   []byte
+}
+
+// NewCompressor returns a writer that deflates onto w. It
+// flushes at the end of every Write, so a message written
+// with one call is never held back waiting for more data,
+// while later messages still benefit from earlier context.
+func NewCompressor(w io.Writer) io.WriteCloser {
+	fw, _ := flate.NewWriter(w, flate.BestSpeed) // err only for bad level
+	return &compressor{w: fw, dst: w}
+}
+
+func (c *compressor) Write(p []byte) (int, error) {
+	if c.reset {
+		// The reader's window has the raw data in it, and
+		// w's doesn't, so w mustn't refer back past it.
+		c.w.Reset(c.dst)
+		c.reset = false
+	}
+	n, err := c.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, c.w.Flush()
+}
+
+func (c *compressor) Close() error {
+	return c.w.Close()
+}
+
+// Raw returns a writer that passes data through c as DEFLATE
+// stored blocks, for data that won't compress. A
+// decompressor needs nothing special to read them.
+func (c *compressor) Raw() io.Writer {
+	return rawWriter{c}
+}
+
+type rawWriter struct{ c *compressor }
+
+// Write writes p in stored blocks of at most 64K. Every
+// Write of the compressor ends in a sync flush, leaving the
+// stream at a byte boundary, where a stored block can start.
+func (r rawWriter) Write(p []byte) (n int, err error) {
+	c := r.c
+	c.reset = true
+	for len(p) > 0 {
+		k := min(len(p), 0xffff)
+		c.buf = append(c.buf[:0], 0, byte(k), byte(k>>8), ^byte(k), ^byte(k>>8))
+		c.buf = append(c.buf, p[:k]...)
+		if _, err = c.dst.Write(c.buf); err != nil {
+			return n, err
+		}
+		n += k
+		p = p[k:]
+	}
+	return n, nil
+}
+
+// NewDecompressor returns a reader that inflates data
+// written by a compressor onto r.
+func NewDecompressor(r io.Reader) io.ReadCloser {
+	return flate.NewReader(r)
+}
+
+type compressed struct {
+	io.Reader
+	*compressor
+}
+
+// Compress wraps both directions of rw.
+func Compress(rw io.ReadWriter) io.ReadWriter {
+	return compressed{NewDecompressor(rw), NewCompressor(rw).(*compressor)}
+}
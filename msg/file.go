@@ -0,0 +1,82 @@
+package msg
+
+import (
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"io"
+)
+
+// Every File message ends with the SHA-256 digest of its
+// contents, which the reading functions check and strip.
+const digestLen = sha256.Size
+
+var (
+	ErrChecksum  = errors.New("file checksum mismatch")
+	ErrTruncated = errors.New("message truncated")
+)
+
+// fileReader reads the contents of a File message, then
+// checks the digest that follows them.
+type fileReader struct {
+	r   io.Reader
+	n   int64 // content bytes left
+	h   hash.Hash
+	err error // sticky
+}
+
+func newFileReader(r io.Reader, n int64) (*fileReader, error) {
+	if n < digestLen {
+		return nil, ErrTruncated
+	}
+	return &fileReader{r: r, n: n - digestLen, h: sha256.New()}, nil
+}
+
+func (f *fileReader) Read(p []byte) (int, error) {
+	if f.err != nil {
+		return 0, f.err
+	}
+	if f.n == 0 {
+		f.err = f.verify()
+		return 0, f.err
+	}
+	if int64(len(p)) > f.n {
+		p = p[:f.n]
+	}
+	n, err := f.r.Read(p)
+	f.n -= int64(n)
+	f.h.Write(p[:n])
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated // the digest, at least, is missing
+	}
+	f.err = err
+	return n, err
+}
+
+// verify reads the digest and returns io.EOF if it matches.
+func (f *fileReader) verify() error {
+	sum := make([]byte, digestLen)
+	if _, err := io.ReadFull(f.r, sum); err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	} else if err != nil {
+		return err
+	}
+	if string(sum) != string(f.h.Sum(nil)) {
+		return ErrChecksum
+	}
+	return io.EOF
+}
+
+// stripDigest checks and removes the digest from the
+// payload of a File message.
+func stripDigest(p []byte) ([]byte, error) {
+	if len(p) < digestLen {
+		return nil, ErrTruncated
+	}
+	n := len(p) - digestLen
+	sum := sha256.Sum256(p[:n])
+	if string(sum[:]) != string(p[n:]) {
+		return nil, ErrChecksum
+	}
+	return p[:n], nil
+}
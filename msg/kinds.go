@@ -0,0 +1,149 @@
+package msg
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// WritePhase writes a Phase message marking the start or
+// end of the named build phase.
+func WritePhase(w io.Writer, name string, start bool) error {
+	return Write(w, Phase, EncodePhase(name, start))
+}
+
+// EncodePhase returns the payload of a Phase message.
+func EncodePhase(name string, start bool) []byte {
+	b := []byte{0}
+	if start {
+		b[0] = 1
+	}
+	return appendString(b, name)
+}
+
+// DecodePhase decodes the payload of a Phase message.
+func DecodePhase(p []byte) (name string, start bool, err error) {
+	if len(p) < 1 {
+		return "", false, ErrMalformed
+	}
+	name, _, err = readString(p[1:])
+	return name, p[0] == 1, err
+}
+
+// WriteProgress writes a Progress message saying done out of
+// total units of the named task are complete.
+func WriteProgress(w io.Writer, name string, done, total int64) error {
+	return Write(w, Progress, EncodeProgress(name, done, total))
+}
+
+// EncodeProgress returns the payload of a Progress message.
+func EncodeProgress(name string, done, total int64) []byte {
+	b := appendString(nil, name)
+	b = appendUvarint(b, uint64(done))
+	return appendUvarint(b, uint64(total))
+}
+
+// DecodeProgress decodes the payload of a Progress message.
+func DecodeProgress(p []byte) (name string, done, total int64, err error) {
+	name, p, err = readString(p)
+	if err != nil {
+		return "", 0, 0, err
+	}
+	d, n := binary.Uvarint(p)
+	if n <= 0 {
+		return "", 0, 0, ErrMalformed
+	}
+	t, m := binary.Uvarint(p[n:])
+	if m <= 0 {
+		return "", 0, 0, ErrMalformed
+	}
+	return name, int64(d), int64(t), nil
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func appendVarint(b []byte, v int64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = appendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// readString reads a string written by appendString
+// and returns it with the rest of p.
+func readString(p []byte) (s string, rest []byte, err error) {
+	l, n := binary.Uvarint(p)
+	if n <= 0 || uint64(len(p)-n) < l {
+		return "", nil, ErrMalformed
+	}
+	p = p[n:]
+	return string(p[:l]), p[l:], nil
+}
+
+// Failure reasons, for Result.Reason.
+const (
+	ReasonBuildpackFetch = "buildpack-fetch"
+	ReasonCompile        = "compile"
+	ReasonProcfile       = "procfile"
+	ReasonInternal       = "internal"
+	ReasonCancelled      = "cancelled"
+	ReasonTimeout        = "timeout"
+)
+
+// A Result is the payload of a Status message.
+type Result struct {
+	Code      byte   // Success or Failure
+	ExitCode  int    // of the failed command, or 0
+	Phase     string // phase the build failed in
+	Reason    string // one of the Reason constants
+	Duration  time.Duration
+	Buildpack string // URL, if known
+}
+
+// WriteStatus writes a Status message carrying res.
+func WriteStatus(w io.Writer, res Result) error {
+	return Write(w, Status, EncodeStatus(res))
+}
+
+// EncodeStatus returns the payload of a Status message.
+func EncodeStatus(res Result) []byte {
+	b := []byte{res.Code}
+	b = appendVarint(b, int64(res.ExitCode))
+	b = appendString(b, res.Phase)
+	b = appendString(b, res.Reason)
+	b = appendVarint(b, int64(res.Duration/time.Millisecond))
+	return appendString(b, res.Buildpack)
+}
+
+// DecodeStatus decodes the payload of a Status message.
+func DecodeStatus(p []byte) (res Result, err error) {
+	if len(p) < 1 {
+		return res, ErrMalformed
+	}
+	res.Code = p[0]
+	code, n := binary.Varint(p[1:])
+	if n <= 0 {
+		return res, ErrMalformed
+	}
+	res.ExitCode = int(code)
+	p = p[1+n:]
+	if res.Phase, p, err = readString(p); err != nil {
+		return res, err
+	}
+	if res.Reason, p, err = readString(p); err != nil {
+		return res, err
+	}
+	ms, n := binary.Varint(p)
+	if n <= 0 {
+		return res, ErrMalformed
+	}
+	res.Duration = time.Duration(ms) * time.Millisecond
+	res.Buildpack, _, err = readString(p[n:])
+	return res, err
+}
@@ -1,121 +1,170 @@
 package msg
 
 import (
-	"bytes"
+	"crypto/sha256"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"strings"
 )
 
 const (
 	User byte = iota
-	File
+	File      // contents, then their SHA-256 digest; see file.go
 	Status
+	Hello
+	Stderr   // a line of compile stderr
+	Phase    // see WritePhase
+	Progress // see WriteProgress
+	Warning  // text worth calling out to the user
+	Data     // mux: channel id, then stream data
+	Eof      // mux: channel id; the sender is done writing
+	Ping     // mux: heartbeat
+	Cancel   // on ControlChan: stop the build; payload is the reason
+
+	lastType = Cancel
 )
 
+// Version is the protocol version spoken by this package.
+// Peers must agree on it exactly; bump it whenever the
+// exchange between hpush and the builder changes.
+const Version = 7
+
+// ErrNoHello means the peer's first message was not a Hello,
+// most likely because it predates versioned handshakes.
+var ErrNoHello = errors.New("peer sent no hello (protocol predates handshake)")
+
+// VersionError reports a protocol version mismatch.
+type VersionError struct {
+	Local, Peer int
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("protocol version mismatch: local %d, peer %d", e.Local, e.Peer)
+}
+
 const (
 	Success = iota
 	Failure
 )
 
-func ReadFile(r io.Reader) (lr io.Reader, err error) {
-	n, t, err := ReadHeader(r)
-	if err == nil {
-		lr = io.LimitReader(r, n)
-	}
-	if t != File {
-		lr, err = nil, fmt.Errorf("expected file: %d", t)
-	}
-	return lr, err
+// WriteHello writes a Hello message carrying Version and caps,
+// the optional features the sender supports.
+func WriteHello(w io.Writer, caps []string) error {
+	b := make([]byte, binary.MaxVarintLen64)
+	b = b[:binary.PutUvarint(b, Version)]
+	b = append(b, strings.Join(caps, " ")...)
+	return Write(w, Hello, b)
 }
 
-func ReadFull(r io.Reader) (t byte, msg []byte, err error) {
-	n, t, err := ReadHeader(r)
+// ReadHello reads a Hello message and returns the peer's
+// version and capabilities.
+func ReadHello(r io.Reader) (version int, caps []string, err error) {
+	t, p, err := ReadFull(r)
 	if err != nil {
 		return 0, nil, err
 	}
-	b := make([]byte, n)
-	_, err = io.ReadFull(r, b)
-	if err != nil {
-		return 0, nil, err
+	if t != Hello {
+		return 0, nil, ErrNoHello
 	}
-	return t, b, nil
+	v, n := binary.Uvarint(p)
+	if n <= 0 {
+		return 0, nil, errors.New("malformed hello")
+	}
+	return int(v), strings.Fields(string(p[n:])), nil
 }
 
-func ReadHeader(r io.Reader) (n int64, t byte, err error) {
-	br, ok := r.(io.ByteReader)
-	if !ok {
-		br = byteReader{r}
+// Handshake sends our Hello on rw and reads the peer's. Both
+// sides write first, so neither waits on the other. It fails
+// with a *VersionError if the versions differ, and returns the
+// capabilities both sides have in common.
+func Handshake(rw io.ReadWriter, caps []string) (common []string, err error) {
+	if err = WriteHello(rw, caps); err != nil {
+		return nil, err
 	}
-	n, err = binary.ReadVarint(br)
+	v, peer, err := ReadHello(rw)
 	if err != nil {
-		return
+		return nil, err
 	}
-	if n < 1 {
-		err = errors.New("empty message")
-		return
+	if v != Version {
+		return nil, &VersionError{Version, v}
 	}
-	b := make([]byte, 1)
-	_, err = r.Read(b)
-	if err != nil {
-		n = 0
-		return
+	for _, c := range caps {
+		for _, p := range peer {
+			if c == p {
+				common = append(common, c)
+				break
+			}
+		}
 	}
-	return n - 1, b[0], nil
+	return common, nil
+}
+
+// ReadFile reads a File message from r; see Reader.ReadFile.
+func ReadFile(r io.Reader) (lr io.Reader, err error) {
+	return newReader(r).ReadFile()
 }
 
+// ReadFull reads a message of at most DefaultMaxSize bytes
+// from r; see Reader.ReadFull.
+func ReadFull(r io.Reader) (t byte, msg []byte, err error) {
+	return newReader(r).ReadFull()
+}
+
+// ReadHeader reads a message header from r; see
+// Reader.ReadHeader.
+func ReadHeader(r io.Reader) (n int64, t byte, err error) {
+	return newReader(r).ReadHeader()
+}
+
+// CopyN writes a message of type t whose payload is the
+// next n bytes of r. It returns ErrTruncated if r has fewer.
 func CopyN(w io.Writer, t byte, r io.Reader, n int64) error {
-	v := make([]byte, binary.MaxVarintLen64)
-	c := binary.PutVarint(v, (n + 1))
-	_, err := w.Write(v[:c])
-	if err != nil {
-		return err
+	size := n
+	h := sha256.New()
+	if t == File {
+		size += digestLen
+		r = io.TeeReader(r, h)
 	}
-	_, err = w.Write([]byte{t})
+	v := make([]byte, binary.MaxVarintLen64+1)
+	c := binary.PutVarint(v, size+1)
+	v[c] = t
+	_, err := w.Write(v[:c+1])
 	if err != nil {
 		return err
 	}
 	z, err := io.CopyN(w, r, n)
-	if z == n {
-		err = nil
+	if z < n && (err == nil || err == io.EOF) {
+		err = ErrTruncated
 	}
-	return err
-}
-
-func Write(w io.Writer, t byte, p []byte) error {
-	v := make([]byte, binary.MaxVarintLen64)
-	c := binary.PutVarint(v, int64(len(p)+1))
-	_, err := w.Write(v[:c])
 	if err != nil {
 		return err
 	}
-	_, err = w.Write([]byte{t})
-	_, err = w.Write(p)
+	if t == File {
+		_, err = w.Write(h.Sum(nil))
+	}
 	return err
 }
 
-type lineWriter struct {
-	w   io.Writer
-	t   byte
-	buf []byte
-}
-
-func LineWriter(w io.Writer, t byte) (lw io.Writer) {
-	return &lineWriter{w: w, t: t}
-}
-
-func (w *lineWriter) Write(p []byte) (n int, err error) {
-	w.buf = append(w.buf, p...)
-	for {
-		pos := bytes.IndexByte(w.buf, '\n')
-		if pos < 0 {
-			break
-		}
-		err = Write(w.w, w.t, w.buf[:pos+1])
-		w.buf = w.buf[pos+1:]
+// Write writes a message of type t with payload p. It makes
+// a single call to w.Write, so concurrent writers sharing a
+// lock per call do not interleave messages.
+func Write(w io.Writer, t byte, p []byte) error {
+	size := len(p)
+	if t == File {
+		size += digestLen
+	}
+	b := make([]byte, binary.MaxVarintLen64, binary.MaxVarintLen64+1+size)
+	b = b[:binary.PutVarint(b, int64(size+1))]
+	b = append(b, t)
+	b = append(b, p...)
+	if t == File {
+		sum := sha256.Sum256(p)
+		b = append(b, sum[:]...)
 	}
-	return len(p), err
+	_, err := w.Write(b)
+	return err
 }
 
 type byteReader struct {
@@ -124,6 +173,6 @@ type byteReader struct {
 
 func (r byteReader) ReadByte() (c byte, err error) {
 	b := make([]byte, 1)
-	_, err = r.Read(b)
+	_, err = io.ReadFull(r, b)
 	return b[0], err
 }
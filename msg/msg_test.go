@@ -1,8 +1,21 @@
 package msg
 
 import (
+	"bufio"
 	"bytes"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestMsg(t *testing.T) {
@@ -10,15 +23,509 @@ func TestMsg(t *testing.T) {
 	Write(b, Status, []byte{Failure})
 	g, p, err := ReadFull(b)
 	if err != nil {
-		t.Error("err w nil, g %d", err)
+		t.Errorf("err w nil, g %v", err)
 	}
 	if g != Status {
-		t.Error("type w %d, g %d", Status, g)
+		t.Errorf("type w %d, g %d", Status, g)
 	}
 	if len(p) != 1 {
-		t.Fatal("len w %d, g %d", 1, len(p))
+		t.Fatalf("len w %d, g %d", 1, len(p))
 	}
 	if p[0] != Failure {
-		t.Fatal("val w %d, g %d", Failure, p[0])
+		t.Fatalf("val w %d, g %d", Failure, p[0])
+	}
+}
+
+func TestAuth(t *testing.T) {
+	now := time.Unix(1400000000, 0)
+	v := Auth("secret", "abc", now)
+	if err := CheckAuth(v, "secret", "abc", now, time.Minute); err != nil {
+		t.Errorf("err w nil, g %v", err)
+	}
+	if err := CheckAuth(v, "other", "abc", now, time.Minute); err != ErrAuthBad {
+		t.Errorf("wrong token: err w %v, g %v", ErrAuthBad, err)
+	}
+	if err := CheckAuth(v, "secret", "abd", now, time.Minute); err != ErrAuthBad {
+		t.Errorf("wrong id: err w %v, g %v", ErrAuthBad, err)
+	}
+	late := now.Add(2 * time.Minute)
+	if err := CheckAuth(v, "secret", "abc", late, time.Minute); err != ErrAuthStale {
+		t.Errorf("late: err w %v, g %v", ErrAuthStale, err)
+	}
+	if err := CheckAuth("", "secret", "abc", now, time.Minute); err != ErrAuthMissing {
+		t.Errorf("empty: err w %v, g %v", ErrAuthMissing, err)
+	}
+}
+
+func TestHandshake(t *testing.T) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+	done := make(chan []string)
+	go func() {
+		caps, err := Handshake(b, []string{"y", "z"})
+		if err != nil {
+			t.Error(err)
+		}
+		done <- caps
+	}()
+	caps, err := Handshake(a, []string{"x", "y"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 1 || caps[0] != "y" {
+		t.Errorf("caps w [y], g %v", caps)
+	}
+	if caps = <-done; len(caps) != 1 || caps[0] != "y" {
+		t.Errorf("peer caps w [y], g %v", caps)
+	}
+}
+
+func TestHandshakeMismatch(t *testing.T) {
+	b := new(bytes.Buffer)
+	Write(b, Hello, []byte{Version + 1})
+	_, _, err := ReadHello(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	Write(b, User, []byte("hi\n"))
+	if _, _, err = ReadHello(b); err != ErrNoHello {
+		t.Errorf("err w %v, g %v", ErrNoHello, err)
+	}
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{new(bytes.Buffer), io.Discard}
+	Write(rw.Reader.(io.Writer), Hello, []byte{Version + 1})
+	_, err = Handshake(rw, nil)
+	if _, ok := err.(*VersionError); !ok {
+		t.Errorf("err w *VersionError, g %v", err)
+	}
+}
+
+// tcpPipe returns both ends of a loopback TCP connection.
+// Unlike net.Pipe, writes are buffered by the kernel.
+func tcpPipe(t *testing.T) (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	a, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, b
+}
+
+func TestKinds(t *testing.T) {
+	b := new(bytes.Buffer)
+	WritePhase(b, "compile", true)
+	WriteProgress(b, "pack", 3, 10)
+	g, p, err := ReadFull(b)
+	if err != nil || g != Phase {
+		t.Fatalf("phase: type %d, err %v", g, err)
+	}
+	name, start, err := DecodePhase(p)
+	if name != "compile" || !start || err != nil {
+		t.Errorf("phase w compile true nil, g %s %v %v", name, start, err)
+	}
+	g, p, err = ReadFull(b)
+	if err != nil || g != Progress {
+		t.Fatalf("progress: type %d, err %v", g, err)
+	}
+	name, done, total, err := DecodeProgress(p)
+	if name != "pack" || done != 3 || total != 10 || err != nil {
+		t.Errorf("progress w pack 3 10 nil, g %s %d %d %v", name, done, total, err)
+	}
+	if _, _, _, err = DecodeProgress([]byte{5, 'x'}); err == nil {
+		t.Error("short progress: err w non-nil, g nil")
+	}
+}
+
+func TestStatus(t *testing.T) {
+	w := Result{Failure, 1, "compile", ReasonCompile, 93 * time.Second, "https://github.com/heroku/heroku-buildpack-go"}
+	b := new(bytes.Buffer)
+	WriteStatus(b, w)
+	_, p, err := ReadFull(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := DecodeStatus(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if g != w {
+		t.Errorf("w %+v, g %+v", w, g)
+	}
+}
+
+func TestMux(t *testing.T) {
+	a, b := tcpPipe(t)
+	ma := NewMux(a, time.Second)
+	mb := NewMux(b, time.Second)
+	defer ma.Close()
+	defer mb.Close()
+
+	big := bytes.Repeat([]byte("x"), 3*maxChunk+7)
+	go func() {
+		ma.Channel(ControlChan).Write([]byte("cancel"))
+		ma.Channel(MainChan).Write(big)
+		ma.Channel(MainChan).CloseWrite()
+	}()
+	got, err := io.ReadAll(mb.Channel(MainChan))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, big) {
+		t.Errorf("main: len w %d, g %d", len(big), len(got))
+	}
+	p := make([]byte, 10)
+	n, err := mb.Channel(ControlChan).Read(p)
+	if err != nil || string(p[:n]) != "cancel" {
+		t.Errorf("control w cancel, g %q %v", p[:n], err)
+	}
+
+	// heartbeats keep an otherwise quiet mux alive
+	time.Sleep(1500 * time.Millisecond)
+	if err := mb.Err(); err != nil {
+		t.Errorf("quiet mux: err w nil, g %v", err)
+	}
+}
+
+func TestMuxIdle(t *testing.T) {
+	a, b := tcpPipe(t)
+	defer a.Close() // a never speaks
+	m := NewMux(b, 200*time.Millisecond)
+	defer m.Close()
+	select {
+	case <-m.Done():
+	case <-time.After(2 * time.Second):
+		t.Fatal("mux did not time out")
+	}
+	if err := m.Err(); err != ErrIdle {
+		t.Errorf("err w %v, g %v", ErrIdle, err)
+	}
+	if _, err := m.Channel(MainChan).Read(make([]byte, 1)); err != ErrIdle {
+		t.Errorf("read err w %v, g %v", ErrIdle, err)
+	}
+}
+
+func TestFile(t *testing.T) {
+	body := bytes.Repeat([]byte("slug"), 1000)
+	b := new(bytes.Buffer)
+	if err := CopyN(b, File, bytes.NewReader(body), int64(len(body))); err != nil {
+		t.Fatal(err)
+	}
+	Write(b, File, []byte("web: x\n"))
+	wire := append([]byte(nil), b.Bytes()...)
+
+	r, err := ReadFile(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Fatalf("file: len w %d nil, g %d %v", len(body), len(got), err)
+	}
+	_, p, err := ReadFull(b)
+	if err != nil || string(p) != "web: x\n" {
+		t.Errorf("procfile w %q nil, g %q %v", "web: x\n", p, err)
+	}
+
+	bad := append([]byte(nil), wire...)
+	bad[100] ^= 1
+	r, _ = ReadFile(bytes.NewReader(bad))
+	if _, err = io.ReadAll(r); err != ErrChecksum {
+		t.Errorf("corrupt: err w %v, g %v", ErrChecksum, err)
+	}
+	for _, n := range []int{100, len(body), len(body) + 10} {
+		r, _ = ReadFile(bytes.NewReader(wire[:n]))
+		if _, err = io.ReadAll(r); err != ErrTruncated {
+			t.Errorf("cut at %d: err w %v, g %v", n, ErrTruncated, err)
+		}
+	}
+
+	err = CopyN(io.Discard, File, bytes.NewReader(body), int64(len(body)+1))
+	if err != ErrTruncated {
+		t.Errorf("short copy: err w %v, g %v", ErrTruncated, err)
+	}
+}
+
+func TestCompress(t *testing.T) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+	ca, cb := Compress(a), Compress(b)
+	line := []byte("-----> compiling, compiling, compiling\n")
+	for i := 0; i < 3; i++ {
+		// each message must arrive before the next is sent
+		if err := Write(ca, User, line); err != nil {
+			t.Fatal(err)
+		}
+		g, p, err := ReadFull(cb)
+		if err != nil || g != User || !bytes.Equal(p, line) {
+			t.Fatalf("msg %d: w %q, g %d %q %v", i, line, g, p, err)
+		}
+	}
+	body := bytes.Repeat([]byte("tarball "), 10000)
+	go CopyN(cb, File, bytes.NewReader(body), int64(len(body)))
+	r, err := ReadFile(ca)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(got, body) {
+		t.Errorf("file: len w %d, g %d %v", len(body), len(got), err)
+	}
+}
+
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (c *countWriter) Write(p []byte) (int, error) {
+	c.n += len(p)
+	return c.w.Write(p)
+}
+
+// Contents sent with CopyNRaw cross the wire as they are,
+// and the stream around them still decompresses.
+func TestCompressRaw(t *testing.T) {
+	a, b := tcpPipe(t)
+	defer a.Close()
+	defer b.Close()
+	wire := &countWriter{w: a}
+	ca := Compress(struct {
+		io.Reader
+		io.Writer
+	}{a, wire})
+	w, r := NewWriter(ca), NewReader(Compress(b))
+	// the second copy of line compresses to a reference to
+	// the first, which must not be confused by the raw body
+	var line []byte
+	sum := sha256.Sum256(nil)
+	for len(line) < 2000 {
+		sum = sha256.Sum256(sum[:])
+		line = hex.AppendEncode(line, sum[:])
+	}
+	body := bytes.Repeat([]byte("slug "), 30000) // two stored blocks
+	done := make(chan error, 1)
+	go func() {
+		w.WriteMsg(User, line)
+		w.CopyNRaw(File, bytes.NewReader(body), int64(len(body)))
+		w.WriteMsg(User, line)
+		done <- w.Flush()
+	}()
+	for i, want := range [][]byte{line, body, line} {
+		_, p, err := r.ReadFull()
+		if err != nil || !bytes.Equal(p, want) {
+			t.Fatalf("msg %d: len w %d, g %d %v", i, len(want), len(p), err)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if wire.n < len(body) {
+		t.Errorf("wire bytes = %d, want over %d, uncompressed", wire.n, len(body))
+	}
+}
+
+func TestReader(t *testing.T) {
+	big := new(bytes.Buffer)
+	Write(big, User, make([]byte, 100))
+	cases := []struct {
+		in  []byte
+		err error
+	}{
+		{nil, io.EOF},
+		{[]byte{0x80}, ErrTruncated},         // mid-varint
+		{[]byte{2}, ErrTruncated},            // no type byte
+		{[]byte{6, User, 'a'}, ErrTruncated}, // short payload
+		{[]byte{0}, ErrMalformed},            // length 0, no room for type
+		{[]byte{1}, ErrMalformed},            // negative length
+		{bytes.Repeat([]byte{0xff}, 11), ErrMalformed},
+		{[]byte{2, 200}, ErrUnknownType},
+		{big.Bytes(), ErrTooLarge},
+	}
+	for _, c := range cases {
+		r := NewReader(bytes.NewReader(c.in))
+		r.MaxSize = 50
+		if _, _, err := r.ReadFull(); err != c.err {
+			t.Errorf("ReadFull(%x): err w %v, g %v", c.in, c.err, err)
+		}
+	}
+}
+
+func FuzzReadHeader(f *testing.F) {
+	b := new(bytes.Buffer)
+	Write(b, User, []byte("hello"))
+	f.Add(b.Bytes())
+	f.Add([]byte{0x80, 0x80})
+	f.Add([]byte{1})
+	f.Fuzz(func(t *testing.T, p []byte) {
+		r := NewReader(bytes.NewReader(p))
+		n, typ, err := r.ReadHeader()
+		if err == nil && (n < 0 || typ > lastType) {
+			t.Errorf("ReadHeader(%x) = %d %d nil", p, n, typ)
+		}
+		r = NewReader(bytes.NewReader(p))
+		_, m, err := r.ReadFull()
+		if err == nil && int64(len(m)) > DefaultMaxSize {
+			t.Errorf("ReadFull(%x): %d bytes", p, len(m))
+		}
+	})
+}
+
+func TestStream(t *testing.T) {
+	b := new(bytes.Buffer)
+	w := NewWriter(b)
+	w.WriteMsg(User, []byte("skipped"))
+	w.CopyN(File, strings.NewReader("slug"), 4)
+	lw := NewLineWriter(w, Stderr)
+	io.WriteString(lw, "one\ntw")
+	io.WriteString(lw, "o")
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReader(b)
+	if h, _, err := r.Next(); err != nil || h.Type != User {
+		t.Fatalf("user: %+v %v", h, err)
+	}
+	h, body, err := r.Next() // skips the unread User body
+	if err != nil || h != (Header{File, 4}) {
+		t.Fatalf("file: %+v %v", h, err)
+	}
+	if p, err := io.ReadAll(body); err != nil || string(p) != "slug" {
+		t.Errorf("file body w slug nil, g %q %v", p, err)
+	}
+	for _, s := range []string{"one\n", "two"} {
+		g, p, err := r.ReadFull()
+		if err != nil || g != Stderr || string(p) != s {
+			t.Errorf("line w %d %q, g %d %q %v", Stderr, s, g, p, err)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("end: err w EOF, g %v", err)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	long := strings.Repeat("x", 2*maxChunk+5)
+	b := new(bytes.Buffer)
+	lw := NewLineWriter(NewWriter(b), User)
+	io.WriteString(lw, "10%\r20%\r")
+	io.WriteString(lw, "done\r\n")
+	io.WriteString(lw, long)
+	if err := lw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"10%\r", "20%\r", "done\r\n", long[:maxChunk], long[maxChunk : 2*maxChunk], long[2*maxChunk:]}
+	r := NewReader(b)
+	for _, s := range want {
+		_, p, err := r.ReadFull()
+		if err != nil || string(p) != s {
+			t.Fatalf("line w %q, g %q %v", trunc(s), trunc(string(p)), err)
+		}
+	}
+	if _, _, err := r.Next(); err != io.EOF {
+		t.Errorf("end: err w EOF, g %v", err)
+	}
+}
+
+func trunc(s string) string {
+	if len(s) > 20 {
+		return s[:20] + "..."
+	}
+	return s
+}
+
+func TestIsUpgrade(t *testing.T) {
+	cases := []struct {
+		conn, upgrade string
+		w             bool
+	}{
+		{"Upgrade", "hpush", true},
+		{"keep-alive, Upgrade", "HPush", true},
+		{"Upgrade", "websocket", false},
+		{"keep-alive", "hpush", false},
+		{"", "", false},
+	}
+	for _, c := range cases {
+		h := http.Header{}
+		h.Set("Connection", c.conn)
+		h.Set("Upgrade", c.upgrade)
+		if g := IsUpgrade(h); g != c.w {
+			t.Errorf("IsUpgrade(%q, %q) = %v, want %v", c.conn, c.upgrade, g, c.w)
+		}
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	u, _ := url.Parse("http://example.com/conn/b1")
+	cases := []struct {
+		resp string
+		w    error
+	}{
+		{UpgradeResponse, nil},
+		{"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n", ErrUpgrade},
+	}
+	for _, c := range cases {
+		a, b := net.Pipe()
+		go func() {
+			r, err := http.ReadRequest(bufio.NewReader(b))
+			if err == nil && IsUpgrade(r.Header) && r.Header.Get(AuthHeader) == "sig" {
+				io.WriteString(b, c.resp+"after")
+			}
+			b.Close()
+		}()
+		if err := Upgrade(a, u, "sig"); err != c.w {
+			t.Errorf("Upgrade with %q: err %v, want %v", c.resp, err, c.w)
+		}
+		if c.w == nil {
+			p, _ := io.ReadAll(a)
+			if string(p) != "after" {
+				t.Errorf("after upgrade: %q, want %q", p, "after")
+			}
+		}
+		a.Close()
+	}
+}
+
+func TestPinnedTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer srv.Close()
+	addr := srv.Listener.Addr().String()
+	pin := Fingerprint(srv.Certificate().Raw)
+
+	c, err := tls.Dial("tcp", addr, PinnedTLSConfig(pin))
+	if err != nil {
+		t.Errorf("matching pin: %v", err)
+	} else {
+		c.Close()
+	}
+
+	wrong := Fingerprint([]byte("some other cert"))
+	if c, err = tls.Dial("tcp", addr, PinnedTLSConfig(wrong)); !errors.Is(err, ErrPinMismatch) {
+		t.Errorf("mismatched pin: err %v, want %v", err, ErrPinMismatch)
+	}
+	if c != nil {
+		c.Close()
+	}
+
+	// with no pin, the test server's self-signed cert is
+	// checked against the system roots, and fails
+	var uae x509.UnknownAuthorityError
+	if c, err = tls.Dial("tcp", addr, PinnedTLSConfig("")); !errors.As(err, &uae) {
+		t.Errorf("no pin: err %v, want unknown authority", err)
+	}
+	if c != nil {
+		c.Close()
 	}
 }
@@ -0,0 +1,241 @@
+package msg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Channel IDs used by hpush and the builder.
+const (
+	MainChan    = 0 // the build exchange
+	ControlChan = 1 // out-of-band requests, such as cancel
+)
+
+const (
+	maxChunk    = 32 << 10 // bytes of stream data per Data frame
+	maxBuffered = 1 << 20  // unread bytes held per channel
+	maxChans    = 16       // channel IDs a peer may use
+)
+
+// ErrIdle means nothing, not even a heartbeat, arrived from
+// the peer within the idle timeout.
+var ErrIdle = errors.New("peer idle too long")
+
+// A Mux carries several byte streams, identified by channel
+// ID, over one connection, interleaved as Data frames. Each
+// side sends a Ping frame periodically, and a Mux gives up on
+// a peer it hasn't heard from within the idle timeout.
+type Mux struct {
+	c    net.Conn
+	idle time.Duration
+
+	wmu sync.Mutex // serializes frame writes
+
+	mu    sync.Mutex
+	chans map[uint64]*Channel
+	err   error // why the mux stopped, once it has
+	done  chan struct{}
+}
+
+// NewMux starts multiplexing over c. If idle is nonzero,
+// heartbeats are sent every idle/3, and reads and writes
+// fail with ErrIdle after idle without progress.
+func NewMux(c net.Conn, idle time.Duration) *Mux {
+	m := &Mux{
+		c:     c,
+		idle:  idle,
+		chans: make(map[uint64]*Channel),
+		done:  make(chan struct{}),
+	}
+	go m.readLoop()
+	if idle > 0 {
+		go m.pingLoop()
+	}
+	return m
+}
+
+// Channel returns the stream with the given id, creating it
+// if necessary.
+func (m *Mux) Channel(id uint64) *Channel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.channel(id)
+}
+
+// channel must be called with m.mu held.
+func (m *Mux) channel(id uint64) *Channel {
+	ch := m.chans[id]
+	if ch == nil {
+		ch = &Channel{m: m, id: id}
+		ch.cond = sync.NewCond(&m.mu)
+		m.chans[id] = ch
+	}
+	return ch
+}
+
+// Done is closed when the mux stops, after which Err
+// says why.
+func (m *Mux) Done() <-chan struct{} {
+	return m.done
+}
+
+// Err returns the reason the mux stopped, or nil.
+func (m *Mux) Err() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.err
+}
+
+// Close closes the underlying connection.
+func (m *Mux) Close() error {
+	err := m.c.Close()
+	m.stop(io.ErrClosedPipe)
+	return err
+}
+
+func (m *Mux) stop(err error) {
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = ErrIdle
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.err != nil {
+		return
+	}
+	m.err = err
+	close(m.done)
+	for _, ch := range m.chans {
+		ch.cond.Broadcast()
+	}
+}
+
+func (m *Mux) readLoop() {
+	r := NewReader(bufio.NewReader(m.c))
+	r.MaxSize = maxChunk + binary.MaxVarintLen64
+	for {
+		if m.idle > 0 {
+			m.c.SetReadDeadline(time.Now().Add(m.idle))
+		}
+		t, p, err := r.ReadFull()
+		if err != nil {
+			m.stop(err)
+			return
+		}
+		switch t {
+		case Ping:
+		case Data, Eof:
+			id, n := binary.Uvarint(p)
+			if n <= 0 || id >= maxChans {
+				m.stop(ErrMalformed)
+				return
+			}
+			m.deliver(id, p[n:], t == Eof)
+		default:
+			m.stop(errors.New("mux: unexpected frame type"))
+			return
+		}
+	}
+}
+
+// deliver queues p for reading on channel id, waiting
+// while the channel has too much unread data.
+func (m *Mux) deliver(id uint64, p []byte, eof bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	ch := m.channel(id)
+	for ch.buf.Len() > maxBuffered && m.err == nil {
+		ch.cond.Wait()
+	}
+	ch.buf.Write(p)
+	ch.eof = ch.eof || eof
+	ch.cond.Broadcast()
+}
+
+func (m *Mux) pingLoop() {
+	t := time.NewTicker(m.idle / 3)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := m.writeFrame(Ping, nil); err != nil {
+				m.stop(err)
+				return
+			}
+		case <-m.done:
+			return
+		}
+	}
+}
+
+func (m *Mux) writeFrame(t byte, p []byte) error {
+	m.wmu.Lock()
+	defer m.wmu.Unlock()
+	if m.idle > 0 {
+		m.c.SetWriteDeadline(time.Now().Add(m.idle))
+	}
+	err := Write(m.c, t, p)
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		err = ErrIdle
+	}
+	return err
+}
+
+// A Channel is one stream of a Mux. Reads and writes may
+// proceed concurrently, but each direction must be used
+// by one goroutine at a time.
+type Channel struct {
+	m    *Mux
+	id   uint64
+	cond *sync.Cond // uses m.mu
+	buf  bytes.Buffer
+	eof  bool // peer called CloseWrite
+}
+
+// Read reads stream data sent by the peer. It returns
+// io.EOF once the peer has closed its side and all data
+// has been read.
+func (ch *Channel) Read(p []byte) (int, error) {
+	m := ch.m
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for ch.buf.Len() == 0 {
+		if ch.eof {
+			return 0, io.EOF
+		}
+		if m.err != nil {
+			return 0, m.err
+		}
+		ch.cond.Wait()
+	}
+	n, _ := ch.buf.Read(p)
+	ch.cond.Broadcast() // wake deliver if it was waiting for room
+	return n, nil
+}
+
+// Write sends p to the peer as one or more Data frames.
+func (ch *Channel) Write(p []byte) (n int, err error) {
+	hdr := appendUvarint(nil, ch.id)
+	for len(p) > 0 {
+		c := len(p)
+		if c > maxChunk {
+			c = maxChunk
+		}
+		if err = ch.m.writeFrame(Data, append(hdr[:len(hdr):len(hdr)], p[:c]...)); err != nil {
+			return n, err
+		}
+		n += c
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// CloseWrite tells the peer no more data will be written.
+func (ch *Channel) CloseWrite() error {
+	return ch.m.writeFrame(Eof, appendUvarint(nil, ch.id))
+}
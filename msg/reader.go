@@ -0,0 +1,205 @@
+package msg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// DefaultMaxSize is the largest message payload ReadFull
+// will read into memory, unless a Reader says otherwise.
+// File contents read with ReadFile are streamed and have
+// no such limit.
+const DefaultMaxSize = 1 << 20
+
+var (
+	ErrTooLarge    = errors.New("message too large")
+	ErrUnknownType = errors.New("unknown message type")
+	ErrMalformed   = errors.New("malformed message")
+)
+
+// A Header describes a message read by Reader.Next.
+type Header struct {
+	Type byte
+	Len  int64 // of the body; for File, without the digest
+}
+
+// A Reader reads messages, checking their framing. It
+// returns io.EOF only at a message boundary, and
+// ErrTruncated if the stream ends in the middle of one.
+//
+// Each read of a header starts a new message, skipping
+// whatever is left unread of the previous one.
+type Reader struct {
+	// MaxSize bounds the payload ReadFull will accept.
+	// Zero means DefaultMaxSize.
+	MaxSize int64
+
+	r    io.Reader
+	br   io.ByteReader
+	left int64 // unread payload of the current message
+}
+
+type byteReadReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+// NewReader returns a Reader reading from r, buffered
+// unless r already implements io.ByteReader.
+func NewReader(r io.Reader) *Reader {
+	br, ok := r.(byteReadReader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+	return &Reader{r: br, br: br}
+}
+
+// newReader returns an unbuffered Reader, for the free
+// functions, which must leave r just past the message.
+func newReader(r io.Reader) *Reader {
+	br, ok := r.(io.ByteReader)
+	if !ok {
+		br = byteReader{r}
+	}
+	return &Reader{r: r, br: br}
+}
+
+func (r *Reader) maxSize() int64 {
+	if r.MaxSize > 0 {
+		return r.MaxSize
+	}
+	return DefaultMaxSize
+}
+
+// ReadHeader reads a message header and returns the payload
+// length and message type. The payload can then be read
+// from r, which returns io.EOF at its end.
+func (r *Reader) ReadHeader() (n int64, t byte, err error) {
+	if r.left > 0 {
+		if _, err = io.Copy(io.Discard, r); err != nil {
+			return 0, 0, err
+		}
+	}
+	n, err = r.readVarint()
+	if err != nil {
+		return 0, 0, err
+	}
+	if n < 1 {
+		return 0, 0, ErrMalformed
+	}
+	t, err = r.br.ReadByte()
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return 0, 0, ErrTruncated
+	} else if err != nil {
+		return 0, 0, err
+	}
+	if t > lastType {
+		return 0, 0, ErrUnknownType
+	}
+	r.left = n - 1
+	return n - 1, t, nil
+}
+
+// readVarint is binary.ReadVarint, but tells a stream that
+// ends mid-varint or an overlong varint from other errors,
+// such as a read timeout, which it passes through.
+func (r *Reader) readVarint() (int64, error) {
+	var ux uint64
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		c, err := r.br.ReadByte()
+		if err == io.EOF && i == 0 {
+			return 0, io.EOF
+		} else if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return 0, ErrTruncated
+		} else if err != nil {
+			return 0, err
+		}
+		if i == binary.MaxVarintLen64-1 && c > 1 {
+			return 0, ErrMalformed
+		}
+		ux |= uint64(c&0x7f) << (7 * uint(i))
+		if c < 0x80 {
+			x := int64(ux >> 1)
+			if ux&1 != 0 {
+				x = ^x
+			}
+			return x, nil
+		}
+	}
+	return 0, ErrMalformed
+}
+
+// Read reads the raw payload of the current message.
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.left == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > r.left {
+		p = p[:r.left]
+	}
+	n, err := r.r.Read(p)
+	r.left -= int64(n)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = ErrTruncated
+	}
+	return n, err
+}
+
+// Next reads the header of the next message and returns a
+// reader for its body. File bodies are checked as they are
+// read, as with ReadFile. The body is valid until the next
+// call to a read method of r.
+func (r *Reader) Next() (Header, io.Reader, error) {
+	n, t, err := r.ReadHeader()
+	if err != nil {
+		return Header{}, nil, err
+	}
+	if t != File {
+		return Header{t, n}, r, nil
+	}
+	f, err := newFileReader(r, n)
+	if err != nil {
+		return Header{}, nil, err
+	}
+	return Header{t, f.n}, f, nil
+}
+
+// ReadFull reads a whole message. It returns ErrTooLarge,
+// without reading the payload, if it is over MaxSize. File
+// payloads are checked and returned without their digest.
+func (r *Reader) ReadFull() (t byte, msg []byte, err error) {
+	n, t, err := r.ReadHeader()
+	if err != nil {
+		return 0, nil, err
+	}
+	if n > r.maxSize() {
+		return 0, nil, ErrTooLarge
+	}
+	b := make([]byte, n)
+	if _, err = io.ReadFull(r, b); err != nil {
+		return 0, nil, err
+	}
+	if t == File {
+		if b, err = stripDigest(b); err != nil {
+			return 0, nil, err
+		}
+	}
+	return t, b, nil
+}
+
+// ReadFile reads the header of a File message and returns a
+// reader for its contents. The reader returns ErrChecksum or
+// ErrTruncated instead of io.EOF if the contents are bad.
+func (r *Reader) ReadFile() (io.Reader, error) {
+	n, t, err := r.ReadHeader()
+	if err != nil {
+		return nil, err
+	}
+	if t != File {
+		return nil, fmt.Errorf("expected file: %d", t)
+	}
+	return newFileReader(r, n)
+}
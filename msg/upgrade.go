@@ -0,0 +1,74 @@
+package msg
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// A builder's callback is an HTTP/1.1 upgrade to protocol
+// UpgradeProto, which routers and proxies tunnel as they do
+// any upgrade. It is deliberately not "websocket": after the
+// 101 response the connection carries this package's frames,
+// and an intermediary that knows WebSocket would try to
+// parse them as its own.
+const UpgradeProto = "hpush"
+
+// UpgradeResponse is hpush's reply to a callback.
+const UpgradeResponse = "HTTP/1.1 101 Switching Protocols\r\n" +
+	"Upgrade: " + UpgradeProto + "\r\n" +
+	"Connection: Upgrade\r\n\r\n"
+
+// ErrUpgrade means the reply to a callback did not switch
+// to UpgradeProto.
+var ErrUpgrade = errors.New("upgrade: protocol not switched")
+
+// IsUpgrade reports whether h asks for an upgrade to
+// UpgradeProto.
+func IsUpgrade(h http.Header) bool {
+	return strings.EqualFold(h.Get("Upgrade"), UpgradeProto) &&
+		strings.Contains(strings.ToLower(h.Get("Connection")), "upgrade")
+}
+
+// Upgrade sends the callback request for URL u, with auth
+// as AuthHeader, over conn, and checks the response. It
+// reads the response a byte at a time, so as not to consume
+// any of what follows.
+func Upgrade(conn net.Conn, u *url.URL, auth string) error {
+	_, err := io.WriteString(conn, "GET "+u.RequestURI()+" HTTP/1.1\r\n"+
+		"Host: "+u.Host+"\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Upgrade: "+UpgradeProto+"\r\n"+
+		AuthHeader+": "+auth+"\r\n\r\n")
+	if err != nil {
+		return err
+	}
+	var head []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(head, []byte("\r\n\r\n")) {
+		if len(head) > 8<<10 {
+			return fmt.Errorf("upgrade: response header too long")
+		}
+		if _, err = io.ReadFull(conn, b); err != nil {
+			return fmt.Errorf("upgrade: %v", err)
+		}
+		head = append(head, b[0])
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(head)), nil)
+	if err != nil {
+		return fmt.Errorf("upgrade: %v", err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		return fmt.Errorf("upgrade: %s", resp.Status)
+	}
+	if !strings.EqualFold(resp.Header.Get("Upgrade"), UpgradeProto) {
+		return ErrUpgrade
+	}
+	return nil
+}
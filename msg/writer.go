@@ -0,0 +1,169 @@
+package msg
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"io"
+	"sync"
+)
+
+// A Writer writes messages, buffering them until Flush.
+// It is safe for concurrent use; messages are written
+// whole, never interleaved. After a write error, every
+// later call returns that error.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	dst io.Writer
+	err error
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w), dst: w}
+}
+
+// WriteMsg writes a message of type t with payload p.
+func (w *Writer) WriteMsg(t byte, p []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if t == File {
+		sum := sha256.Sum256(p)
+		w.header(int64(len(p)+digestLen), t)
+		w.write(p)
+		w.write(sum[:])
+	} else {
+		w.header(int64(len(p)), t)
+		w.write(p)
+	}
+	return w.err
+}
+
+// CopyN writes a message of type t whose payload is the
+// next n bytes of r. It returns ErrTruncated if r has fewer.
+// Since the header has already gone out by then, that, or
+// an error reading r, also breaks w.
+func (w *Writer) CopyN(t byte, r io.Reader, n int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.copyN(t, r, n, false)
+}
+
+// CopyNRaw is CopyN for contents that won't compress, such
+// as a gzipped slug. If w writes to a compressor (see
+// Compress), the contents bypass it.
+func (w *Writer) CopyNRaw(t byte, r io.Reader, n int64) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.copyN(t, r, n, true)
+}
+
+func (w *Writer) copyN(t byte, r io.Reader, n int64, raw bool) error {
+	size := n
+	h := sha256.New()
+	if t == File {
+		size += digestLen
+		r = io.TeeReader(r, h)
+	}
+	w.header(size, t)
+	var dst io.Writer = w.w
+	if c, ok := w.dst.(interface{ Raw() io.Writer }); raw && ok && w.err == nil {
+		w.err = w.w.Flush() // the header goes first
+		dst = c.Raw()
+	}
+	if w.err != nil {
+		return w.err
+	}
+	z, err := io.CopyN(dst, r, n)
+	if z < n && (err == nil || err == io.EOF) {
+		err = ErrTruncated
+	}
+	if err != nil {
+		w.err = err
+		return err
+	}
+	if t == File {
+		w.write(h.Sum(nil))
+	}
+	return w.err
+}
+
+// Flush writes any buffered messages to the underlying
+// io.Writer.
+func (w *Writer) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *Writer) header(size int64, t byte) {
+	var b [binary.MaxVarintLen64 + 1]byte
+	n := binary.PutVarint(b[:], size+1)
+	b[n] = t
+	w.write(b[:n+1])
+}
+
+func (w *Writer) write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+// A LineWriter sends each line written to it as a message
+// of one type, flushing its Writer after every Write. A line
+// ends at \n or \r, so that progress bars show up as they
+// are drawn, or after maxChunk bytes, to keep messages well
+// inside the reader's MaxSize.
+type LineWriter struct {
+	w   *Writer
+	t   byte
+	buf []byte
+}
+
+// NewLineWriter returns a LineWriter sending messages of
+// type t to w.
+func NewLineWriter(w *Writer, t byte) *LineWriter {
+	return &LineWriter{w: w, t: t}
+}
+
+func (lw *LineWriter) Write(p []byte) (n int, err error) {
+	lw.buf = append(lw.buf, p...)
+	for {
+		pos := bytes.IndexAny(lw.buf, "\r\n")
+		if pos < 0 || pos >= maxChunk {
+			if len(lw.buf) < maxChunk {
+				break
+			}
+			pos = maxChunk - 1
+		} else if lw.buf[pos] == '\r' && pos+1 < len(lw.buf) && lw.buf[pos+1] == '\n' {
+			pos++
+		}
+		if err = lw.w.WriteMsg(lw.t, lw.buf[:pos+1]); err != nil {
+			return len(p), err
+		}
+		lw.buf = lw.buf[pos+1:]
+	}
+	return len(p), lw.w.Flush()
+}
+
+// Flush sends any partial line held back by Write, then
+// flushes the Writer.
+func (lw *LineWriter) Flush() error {
+	if len(lw.buf) > 0 {
+		if err := lw.w.WriteMsg(lw.t, lw.buf); err != nil {
+			return err
+		}
+		lw.buf = nil
+	}
+	return lw.w.Flush()
+}
+
+// Close flushes lw. It does not close the Writer.
+func (lw *LineWriter) Close() error {
+	return lw.Flush()
+}
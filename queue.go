@@ -0,0 +1,162 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+)
+
+// Pushes wait in a FIFO queue for a build slot. At most
+// HPUSH_MAX_BUILDS builds run at once (0 means no limit), and
+// at most HPUSH_MAX_APP_BUILDS per app, by default 1, so that
+// pushes to one app release in the order they were made. A
+// push held back only by its app's limit doesn't hold back
+// pushes to other apps. With HPUSH_SUPERSEDE set, a new push
+// to an app replaces any of that app's pushes still queued.
+var queue = &buildQueue{maxApp: 1, apps: make(map[string]int)}
+
+var errSuperseded = errors.New("superseded by a newer push")
+
+type buildQueue struct {
+	max       int
+	maxApp    int
+	supersede bool
+
+	mu      sync.Mutex
+	running int
+	apps    map[string]int // running builds per app
+	waiting []*ticket
+}
+
+// A ticket is a push's place in the queue.
+type ticket struct {
+	q     *buildQueue
+	app   string
+	ready chan error    // receives nil once admitted
+	moved chan struct{} // signaled when the queue changes
+	held  bool          // admitted and not yet done
+}
+
+// enter puts a push to app in the queue, admitting it at
+// once if there is room.
+func (q *buildQueue) enter(app string) *ticket {
+	t := &ticket{
+		q:     q,
+		app:   app,
+		ready: make(chan error, 1),
+		moved: make(chan struct{}, 1),
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.supersede {
+		a := q.waiting[:0]
+		for _, u := range q.waiting {
+			if u.app == app {
+				u.ready <- errSuperseded
+			} else {
+				a = append(a, u)
+			}
+		}
+		q.waiting = a
+	}
+	q.waiting = append(q.waiting, t)
+	q.admit()
+	return t
+}
+
+// admit must be called with q.mu held.
+func (q *buildQueue) admit() {
+	a := q.waiting[:0]
+	for _, t := range q.waiting {
+		if (q.max > 0 && q.running >= q.max) || (q.maxApp > 0 && q.apps[t.app] >= q.maxApp) {
+			a = append(a, t)
+			continue
+		}
+		q.running++
+		q.apps[t.app]++
+		t.held = true
+		t.ready <- nil
+	}
+	for i := len(a); i < len(q.waiting); i++ {
+		q.waiting[i] = nil
+	}
+	q.waiting = a
+	for _, t := range q.waiting {
+		select {
+		case t.moved <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// admitted reports whether t may start right away.
+func (t *ticket) admitted() bool {
+	t.q.mu.Lock()
+	defer t.q.mu.Unlock()
+	return t.held
+}
+
+// ahead returns the number of pushes queued before t that
+// will be admitted before it: those to its app, and, if the
+// global limit applies, those not held back by their own
+// app's limit.
+func (t *ticket) ahead() int {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for _, u := range q.waiting {
+		if u == t {
+			return n
+		}
+		if u.app == t.app || q.max > 0 && (q.maxApp <= 0 || q.apps[u.app] < q.maxApp) {
+			n++
+		}
+	}
+	return 0 // not queued
+}
+
+// wait waits for t to be admitted, telling w its position
+// whenever that changes. It gives up when ctx is done or
+// hpush is interrupted.
+func (t *ticket) wait(ctx context.Context, w io.Writer) error {
+	last := -1
+	for {
+		if n := t.ahead(); n != last {
+			fprintf(w, "queued, %d ahead\n", n)
+			last = n
+		}
+		select {
+		case err := <-t.ready:
+			return err
+		case <-t.moved:
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		case <-interrupted.Done():
+			return context.Cause(interrupted)
+		}
+	}
+}
+
+// done gives up t's place in the queue or its build slot.
+func (t *ticket) done() {
+	q := t.q
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if t.held {
+		t.held = false
+		q.running--
+		if q.apps[t.app]--; q.apps[t.app] == 0 {
+			delete(q.apps, t.app)
+		}
+	} else {
+		for i, u := range q.waiting {
+			if u == t {
+				q.waiting = append(q.waiting[:i], q.waiting[i+1:]...)
+				break
+			}
+		}
+	}
+	q.admit()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func newQueue(max, maxApp int) *buildQueue {
+	return &buildQueue{max: max, maxApp: maxApp, apps: make(map[string]int)}
+}
+
+// ready reports whether t has heard back from the queue, and
+// if so what: nil if admitted, an error if turned away.
+func ready(t *ticket) (ok bool, err error) {
+	select {
+	case err = <-t.ready:
+		return true, err
+	default:
+		return false, nil
+	}
+}
+
+func TestQueueAdmit(t *testing.T) {
+	q := newQueue(2, 0)
+	t1, t2, t3 := q.enter("a"), q.enter("b"), q.enter("c")
+	if !t1.admitted() || !t2.admitted() || t3.admitted() {
+		t.Fatalf("admitted = %v %v %v, want true true false", t1.admitted(), t2.admitted(), t3.admitted())
+	}
+	if n := t3.ahead(); n != 0 {
+		t.Errorf("ahead = %d, want 0", n)
+	}
+	t2.done()
+	if ok, err := ready(t3); !ok || err != nil || !t3.admitted() {
+		t.Fatalf("after done: ready = %v, %v, want admitted", ok, err)
+	}
+	t1.done()
+	t3.done()
+	if q.running != 0 || len(q.apps) != 0 || len(q.waiting) != 0 {
+		t.Errorf("queue not empty: %d running, apps %v, %d waiting", q.running, q.apps, len(q.waiting))
+	}
+}
+
+func TestQueueAppLimit(t *testing.T) {
+	q := newQueue(0, 1)
+	a1, a2, b1, a3 := q.enter("a"), q.enter("a"), q.enter("b"), q.enter("a")
+	if !a1.admitted() || a2.admitted() || !b1.admitted() || a3.admitted() {
+		t.Fatalf("admitted = %v %v %v %v, want true false true false",
+			a1.admitted(), a2.admitted(), b1.admitted(), a3.admitted())
+	}
+	a1.done()
+	if ok, _ := ready(a2); !ok {
+		t.Fatal("a2 not admitted after a1")
+	}
+	if a3.admitted() {
+		t.Fatal("a3 admitted alongside a2")
+	}
+	a2.done()
+	if ok, _ := ready(a3); !ok {
+		t.Fatal("a3 not admitted after a2")
+	}
+}
+
+func TestQueueAhead(t *testing.T) {
+	q := newQueue(2, 1)
+	q.enter("a")
+	q.enter("b")
+	a2, c1, b2, a3 := q.enter("a"), q.enter("c"), q.enter("b"), q.enter("a")
+	// a2 and b2 wait for their apps, c1 for a free slot.
+	for _, tc := range []struct {
+		t    *ticket
+		want int
+	}{{a2, 0}, {c1, 0}, {b2, 1}, {a3, 2}} {
+		if n := tc.t.ahead(); n != tc.want {
+			t.Errorf("%s: ahead = %d, want %d", tc.t.app, n, tc.want)
+		}
+	}
+}
+
+func TestQueueSupersede(t *testing.T) {
+	q := newQueue(0, 1)
+	q.supersede = true
+	a1, a2, b1 := q.enter("a"), q.enter("a"), q.enter("b")
+	b2 := q.enter("b")
+	a3 := q.enter("a")
+	if ok, err := ready(a2); !ok || err != errSuperseded {
+		t.Errorf("a2: ready = %v, %v, want %v", ok, err, errSuperseded)
+	}
+	if ok, _ := ready(b2); ok {
+		t.Error("b2 superseded by a push to another app")
+	}
+	if !a1.admitted() || !b1.admitted() || a3.admitted() {
+		t.Error("superseding disturbed running builds")
+	}
+	a1.done()
+	if ok, err := ready(a3); !ok || err != nil {
+		t.Errorf("a3: ready = %v, %v, want admitted", ok, err)
+	}
+}
+
+// Pushes must line up for the deploy lock in the same order
+// as for the build queue.
+func TestEnterPushOrder(t *testing.T) {
+	oldLocks, oldQueue := locks, queue
+	defer func() { locks, queue = oldLocks, oldQueue }()
+	locks = newLocks("queue")
+	queue = newQueue(0, 1)
+
+	type push struct {
+		e *lockEntry
+		t *ticket
+	}
+	var (
+		mu     sync.Mutex
+		pushes []push
+		wg     sync.WaitGroup
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, t, err := enterPush("a")
+			if err != nil {
+				panic(err)
+			}
+			mu.Lock()
+			pushes = append(pushes, push{e, t})
+			mu.Unlock()
+		}()
+	}
+	wg.Wait()
+
+	pos := make(map[*ticket]int)
+	for i, u := range queue.waiting {
+		pos[u] = i + 1 // 0 is the admitted one
+	}
+	for _, p := range pushes {
+		want := fmt.Sprint(pos[p.t])
+		got := "?"
+		for i, e := range locks.apps["a"] {
+			if e == p.e {
+				got = fmt.Sprint(i)
+			}
+		}
+		if got != want {
+			t.Fatalf("lock position %s, queue position %s", got, want)
+		}
+	}
+}
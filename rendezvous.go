@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/kr/hpush/msg"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When several hpush instances run behind a router, a
+// builder's callback may reach any of them. The rendezvous
+// store maps each waiting build ID to the peer URL of the
+// instance holding the push, and an instance that gets a
+// callback it isn't waiting for forwards the connection
+// there. The in-memory store, the default, is only right
+// for a single instance.
+//
+// HPUSH_RENDEZVOUS selects a shared store:
+//
+//	redis://[:password@]host:port[/db]
+//	rediss://...  (the same, over TLS)
+//
+// HPUSH_PEER_URL is where other instances can reach this
+// one, by default its conn URL, which is https if
+// HPUSH_TLS_PORT is set. Set it if HPUSH_CALLBACK_URL is an
+// address shared by all instances. An https peer is pinned
+// to this instance's own certificate, so instances that
+// forward to each other over TLS must share one (see
+// HPUSH_TLS_CERT and HPUSH_TLS_KEY).
+type rendezvousStore interface {
+	Put(id, owner string, ttl time.Duration) error
+	Get(id string) (owner string, err error) // "" if unknown
+	Delete(id string) error
+}
+
+// rendezvousTTL bounds how long an entry outlives a push
+// that failed to delete it. Matching deletes it promptly.
+const rendezvousTTL = 10 * time.Minute
+
+// forwardedHeader marks a callback forwarded by a peer, and
+// carries the builder's address. A forwarded callback is
+// never forwarded again.
+const forwardedHeader = "X-Hpush-Forwarded"
+
+var (
+	rendezvous rendezvousStore = newMemStore()
+	peerURL    string
+)
+
+func openRendezvous(s string) (rendezvousStore, error) {
+	if s == "" {
+		return newMemStore(), nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return nil, err
+	}
+	switch u.Scheme {
+	case "redis", "rediss":
+		return newRedisStore(u)
+	}
+	return nil, fmt.Errorf("unknown rendezvous store %q", u.Scheme)
+}
+
+type memStore struct {
+	mu sync.Mutex
+	m  map[string]memEntry
+}
+
+type memEntry struct {
+	owner   string
+	expires time.Time
+}
+
+func newMemStore() *memStore {
+	return &memStore{m: make(map[string]memEntry)}
+}
+
+func (s *memStore) Put(id, owner string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now()
+	for k, e := range s.m {
+		if now.After(e.expires) {
+			delete(s.m, k)
+		}
+	}
+	s.m[id] = memEntry{owner, now.Add(ttl)}
+	return nil
+}
+
+func (s *memStore) Get(id string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.m[id]
+	if !ok || time.Now().After(e.expires) {
+		return "", nil
+	}
+	return e.owner, nil
+}
+
+func (s *memStore) Delete(id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.m, id)
+	return nil
+}
+
+// redisStore speaks just enough RESP for SET, GET and DEL,
+// over one connection, redialed after any error.
+type redisStore struct {
+	addr     string
+	tls      bool
+	password string
+	db       int
+
+	mu sync.Mutex
+	c  net.Conn
+	r  *bufio.Reader
+}
+
+const (
+	redisPrefix  = "hpush:rendezvous:"
+	redisTimeout = 5 * time.Second
+)
+
+var errRedisNil = errors.New("redis: nil")
+
+func newRedisStore(u *url.URL) (*redisStore, error) {
+	s := &redisStore{addr: u.Host, tls: u.Scheme == "rediss"}
+	if u.User != nil {
+		s.password, _ = u.User.Password()
+	}
+	if p := strings.Trim(u.Path, "/"); p != "" {
+		db, err := strconv.Atoi(p)
+		if err != nil {
+			return nil, fmt.Errorf("redis db: %v", err)
+		}
+		s.db = db
+	}
+	if u.Port() == "" {
+		s.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	return s, nil
+}
+
+func (s *redisStore) Put(id, owner string, ttl time.Duration) error {
+	ms := strconv.FormatInt(int64(ttl/time.Millisecond), 10)
+	_, err := s.do("SET", redisPrefix+id, owner, "PX", ms)
+	return err
+}
+
+func (s *redisStore) Get(id string) (string, error) {
+	v, err := s.do("GET", redisPrefix+id)
+	if err == errRedisNil {
+		return "", nil
+	}
+	return v, err
+}
+
+func (s *redisStore) Delete(id string) error {
+	_, err := s.do("DEL", redisPrefix+id)
+	return err
+}
+
+// do sends a command and returns its reply, which must be
+// a simple string, integer or bulk string.
+func (s *redisStore) do(args ...string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.c == nil {
+		if err := s.dial(); err != nil {
+			return "", err
+		}
+	}
+	v, err := s.roundTrip(args)
+	if _, ok := err.(redisError); !ok && err != nil && err != errRedisNil {
+		s.c.Close()
+		s.c = nil
+	}
+	return v, err
+}
+
+func (s *redisStore) dial() (err error) {
+	d := &net.Dialer{Timeout: redisTimeout}
+	if s.tls {
+		s.c, err = tls.DialWithDialer(d, "tcp", s.addr, nil)
+	} else {
+		s.c, err = d.Dial("tcp", s.addr)
+	}
+	if err != nil {
+		s.c = nil
+		return err
+	}
+	s.r = bufio.NewReader(s.c)
+	if s.password != "" {
+		_, err = s.roundTrip([]string{"AUTH", s.password})
+	}
+	if err == nil && s.db != 0 {
+		_, err = s.roundTrip([]string{"SELECT", strconv.Itoa(s.db)})
+	}
+	if err != nil {
+		s.c.Close()
+		s.c = nil
+	}
+	return err
+}
+
+func (s *redisStore) roundTrip(args []string) (string, error) {
+	s.c.SetDeadline(time.Now().Add(redisTimeout))
+	b := []byte("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, a := range args {
+		b = append(b, "$"+strconv.Itoa(len(a))+"\r\n"+a+"\r\n"...)
+	}
+	if _, err := s.c.Write(b); err != nil {
+		return "", err
+	}
+	line, err := s.readLine()
+	if err != nil {
+		return "", err
+	}
+	switch line[0] {
+	case '+', ':':
+		return line[1:], nil
+	case '-':
+		return "", redisError(line[1:])
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return "", fmt.Errorf("redis: bad reply %q", line)
+		}
+		if n < 0 {
+			return "", errRedisNil
+		}
+		p := make([]byte, n+2)
+		if _, err = io.ReadFull(s.r, p); err != nil {
+			return "", err
+		}
+		return string(p[:n]), nil
+	}
+	return "", fmt.Errorf("redis: unexpected reply %q", line)
+}
+
+func (s *redisStore) readLine() (string, error) {
+	line, err := s.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return "", errors.New("redis: empty reply")
+	}
+	return line, nil
+}
+
+// A redisError is an error reply; the connection is fine.
+type redisError string
+
+func (e redisError) Error() string { return "redis: " + string(e) }
+
+// routeConn forwards builder connection c to the instance
+// waiting for it, if that's not this one, and reports
+// whether it took charge of c.
+func routeConn(c net.Conn, id string, r *http.Request) bool {
+	owner, err := rendezvous.Get(id)
+	if err != nil {
+		slog.Error("rendezvous get", "build", id, "err", err)
+		return false // maybe it's ours; match will tell
+	}
+	if owner == "" || owner == peerURL {
+		return false
+	}
+	if r.Header.Get(forwardedHeader) != "" {
+		slog.Warn("conn forwarded here, but owned by peer", "build", id, "addr", r.RemoteAddr, "peer", owner)
+		c.Close()
+		return true
+	}
+	go forwardConn(c, owner, id, r)
+	return true
+}
+
+// forwardConn replays the callback request to owner, over
+// TLS pinned to our own certificate if owner is https, then
+// copies bytes both ways until either side is done.
+func forwardConn(c net.Conn, owner, id string, r *http.Request) {
+	defer c.Close()
+	u, err := url.Parse(owner)
+	if err != nil {
+		slog.Error("forward conn", "build", id, "peer", owner, "err", err)
+		return
+	}
+	host := u.Host
+	if u.Port() == "" && u.Scheme == "https" {
+		host = net.JoinHostPort(u.Hostname(), "443")
+	} else if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "80")
+	}
+	d := &net.Dialer{Timeout: MatchTimeout}
+	var pc net.Conn
+	if u.Scheme == "https" {
+		pc, err = tls.DialWithDialer(d, "tcp", host, msg.PinnedTLSConfig(tlsPin))
+	} else {
+		pc, err = d.Dial("tcp", host)
+	}
+	if err != nil {
+		slog.Error("forward conn", "build", id, "peer", owner, "err", err)
+		return
+	}
+	defer pc.Close()
+	slog.Info("forwarding conn", "build", id, "addr", r.RemoteAddr, "peer", owner)
+	_, err = fmt.Fprintf(pc, "X %s/conn/%s HTTP/1.1\r\nHost: %s\r\n%s: %s\r\n%s: %s\r\n\r\n",
+		strings.TrimRight(u.Path, "/"), id, u.Host,
+		msg.AuthHeader, r.Header.Get(msg.AuthHeader),
+		forwardedHeader, r.RemoteAddr)
+	if err != nil {
+		slog.Error("forward conn", "build", id, "peer", owner, "err", err)
+		return
+	}
+	done := make(chan struct{})
+	go func() {
+		io.Copy(pc, c)
+		if cw, ok := pc.(interface{ CloseWrite() error }); ok {
+			cw.CloseWrite()
+		}
+		close(done)
+	}()
+	io.Copy(c, pc)
+	c.Close()
+	<-done
+}
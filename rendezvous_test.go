@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/kr/hpush/msg"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeRedis is just enough of a redis server for redisStore.
+// Getting key "err" gets an error reply, and getting "drop"
+// gets the connection closed.
+type fakeRedis struct {
+	l        net.Listener
+	password string
+
+	mu    sync.Mutex
+	m     map[string]string
+	conns int
+	cmds  []string
+}
+
+func newFakeRedis(t *testing.T, password string) *fakeRedis {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{l: l, password: password, m: make(map[string]string)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return f
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	authed := f.password == ""
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		f.cmds = append(f.cmds, strings.Join(args, " "))
+		var reply string
+		switch cmd := strings.ToUpper(args[0]); {
+		case cmd == "AUTH":
+			authed = len(args) == 2 && args[1] == f.password
+			reply = "+OK\r\n"
+			if !authed {
+				reply = "-WRONGPASS invalid password\r\n"
+			}
+		case !authed:
+			reply = "-NOAUTH Authentication required.\r\n"
+		case cmd == "SELECT":
+			reply = "+OK\r\n"
+		case cmd == "SET":
+			f.m[args[1]] = args[2]
+			reply = "+OK\r\n"
+		case cmd == "GET" && args[1] == redisPrefix+"err":
+			reply = "-ERR boom\r\n"
+		case cmd == "GET" && args[1] == redisPrefix+"drop":
+			f.mu.Unlock()
+			return
+		case cmd == "GET":
+			v, ok := f.m[args[1]]
+			reply = "$-1\r\n"
+			if ok {
+				reply = "$" + strconv.Itoa(len(v)) + "\r\n" + v + "\r\n"
+			}
+		case cmd == "DEL":
+			_, ok := f.m[args[1]]
+			delete(f.m, args[1])
+			reply = ":0\r\n"
+			if ok {
+				reply = ":1\r\n"
+			}
+		default:
+			reply = "-ERR unknown command\r\n"
+		}
+		f.mu.Unlock()
+		if _, err = io.WriteString(c, reply); err != nil {
+			return
+		}
+	}
+}
+
+// seen returns the number of connections accepted and the
+// commands received so far.
+func (f *fakeRedis) seen() (int, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.conns, append([]string(nil), f.cmds...)
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil || line[0] != '*' {
+		return nil, io.ErrUnexpectedEOF
+	}
+	args := make([]string, n)
+	for i := range args {
+		if line, err = r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		size, _ := strconv.Atoi(strings.TrimSpace(line[1:]))
+		p := make([]byte, size+2)
+		if _, err = io.ReadFull(r, p); err != nil {
+			return nil, err
+		}
+		args[i] = string(p[:size])
+	}
+	return args, nil
+}
+
+func TestRedisStore(t *testing.T) {
+	f := newFakeRedis(t, "pw")
+	u, _ := url.Parse("redis://:pw@" + f.l.Addr().String() + "/2")
+	s, err := openRendezvous(u.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err = s.Put("b1", "https://peer", time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if owner, err := s.Get("b1"); err != nil || owner != "https://peer" {
+		t.Errorf("Get = %q %v, want https://peer", owner, err)
+	}
+	if owner, err := s.Get("nope"); err != nil || owner != "" {
+		t.Errorf("Get missing = %q %v, want empty", owner, err)
+	}
+	if err = s.Delete("b1"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := s.Get("b1"); owner != "" {
+		t.Errorf("Get after Delete = %q", owner)
+	}
+	want := []string{"AUTH pw", "SELECT 2", "SET " + redisPrefix + "b1 https://peer PX 60000"}
+	_, cmds := f.seen()
+	for i, cmd := range want {
+		if cmds[i] != cmd {
+			t.Errorf("command %d = %q, want %q", i, cmds[i], cmd)
+		}
+	}
+
+	if _, err = s.Get("err"); err == nil || err.Error() != "redis: ERR boom" {
+		t.Errorf("error reply: err = %v", err)
+	}
+	_, err = s.Get("b1")
+	if n, _ := f.seen(); err != nil || n != 1 {
+		t.Errorf("after error reply: %v, %d conns, want the same one", err, n)
+	}
+
+	if _, err = s.Get("drop"); err == nil {
+		t.Error("dropped conn: no error")
+	}
+	if err = s.Put("b2", "x", time.Minute); err != nil {
+		t.Fatalf("after drop: %v", err)
+	}
+	if n, _ := f.seen(); n != 2 {
+		t.Errorf("%d conns, want a redial", n)
+	}
+}
+
+func TestRedisStoreBadPassword(t *testing.T) {
+	f := newFakeRedis(t, "pw")
+	s, err := openRendezvous("redis://:wrong@" + f.l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.Put("b1", "x", time.Minute); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Put with bad password: err = %v", err)
+	}
+}
+
+// A callback that reaches the wrong instance must be relayed
+// to the one waiting for it, over TLS pinned to the shared
+// certificate, and carry bytes both ways from then on.
+func TestRouteConn(t *testing.T) {
+	got := make(chan *http.Request, 1)
+	owner := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		c, brw, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			return
+		}
+		defer c.Close()
+		got <- r
+		io.Copy(c, brw) // echo
+	}))
+	defer owner.Close()
+	mux := http.NewServeMux()
+	mux.Handle("/conn/", http.StripPrefix("/conn/", errHandler{handleConn}))
+	here := httptest.NewServer(mux)
+	defer here.Close()
+
+	oldStore, oldPeer, oldPin := rendezvous, peerURL, tlsPin
+	defer func() { rendezvous, peerURL, tlsPin = oldStore, oldPeer, oldPin }()
+	rendezvous = newMemStore()
+	peerURL = here.URL
+	tlsPin = msg.Fingerprint(owner.Certificate().Raw)
+	rendezvous.Put("b1", owner.URL, time.Minute)
+
+	u, _ := url.Parse(here.URL)
+	c, err := net.Dial("tcp", u.Host)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	fmt.Fprintf(c, "X /conn/b1 HTTP/1.1\r\nHost: %s\r\n%s: sig\r\n\r\n", u.Host, msg.AuthHeader)
+
+	var r *http.Request
+	select {
+	case r = <-got:
+	case <-time.After(5 * time.Second):
+		t.Fatal("conn not relayed to its owner")
+	}
+	if r.Method != "X" || r.URL.Path != "/conn/b1" || r.Header.Get(msg.AuthHeader) != "sig" || r.Header.Get(forwardedHeader) == "" {
+		t.Errorf("relayed request = %s %s %v", r.Method, r.URL.Path, r.Header)
+	}
+	io.WriteString(c, "hello")
+	b := make([]byte, 5)
+	if _, err = io.ReadFull(c, b); err != nil || string(b) != "hello" {
+		t.Fatalf("echo: %q %v", b, err)
+	}
+}
+
+// A peer whose certificate doesn't match the pin gets
+// nothing.
+func TestRouteConnBadPin(t *testing.T) {
+	got := make(chan bool, 1)
+	owner := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got <- true
+	}))
+	defer owner.Close()
+	oldStore, oldPeer, oldPin := rendezvous, peerURL, tlsPin
+	defer func() { rendezvous, peerURL, tlsPin = oldStore, oldPeer, oldPin }()
+	rendezvous = newMemStore()
+	peerURL = "http://here.invalid"
+	tlsPin = strings.Repeat("0", 64)
+	rendezvous.Put("b1", owner.URL, time.Minute)
+
+	a, b := net.Pipe()
+	defer b.Close()
+	r := httptest.NewRequest("X", "/b1", nil)
+	if !routeConn(a, "b1", r) {
+		t.Fatal("routeConn kept a conn owned by a peer")
+	}
+	b.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := b.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("read = %v, want EOF once the dial fails", err)
+	}
+	select {
+	case <-got:
+		t.Error("request reached a peer with the wrong certificate")
+	default:
+	}
+}
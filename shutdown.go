@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// On SIGTERM or SIGINT, hpush drains: new pushes get 503,
+// and pushes in flight have HPUSH_DRAIN_TIMEOUT to finish.
+// Builds still running then are interrupted, which stops
+// their dynos and tells their clients to push again.
+// Builder callbacks are accepted throughout.
+const defaultDrainTimeout = 15 * time.Second // Heroku kills 30s after SIGTERM
+
+var errInterrupted = errors.New("hpush is shutting down")
+
+// interrupted is done, with cause errInterrupted, once
+// draining has run out of time.
+var interrupted, interrupt = context.WithCancelCause(context.Background())
+
+var pushes struct {
+	sync.Mutex
+	n        int // in flight
+	draining bool
+}
+
+// beginPush counts a new push, unless hpush is draining.
+func beginPush() bool {
+	pushes.Lock()
+	defer pushes.Unlock()
+	if pushes.draining {
+		return false
+	}
+	pushes.n++
+	return true
+}
+
+func endPush() {
+	pushes.Lock()
+	pushes.n--
+	pushes.Unlock()
+}
+
+func drain() (inFlight int) {
+	pushes.Lock()
+	defer pushes.Unlock()
+	pushes.draining = true
+	return pushes.n
+}
+
+func shutdown(srvs []*http.Server, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	last := time.Now()
+	for n := drain(); n > 0; n = drain() {
+		if time.Now().After(deadline) {
+			slog.Warn("drain: interrupting pushes", "pushes", n)
+			interrupt(errInterrupted)
+			break
+		}
+		if time.Since(last) > 5*time.Second {
+			slog.Info("drain: waiting for pushes", "pushes", n)
+			last = time.Now()
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+	// Give interrupted pushes time to wind up their
+	// builders and stop their dynos.
+	ctx, cancel := context.WithTimeout(context.Background(), CancelGrace+5*time.Second)
+	defer cancel()
+	for _, srv := range srvs {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("shutdown", "err", err)
+		}
+	}
+}
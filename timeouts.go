@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/kr/hpush/msg"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Phase timeouts. The builder enforces fetch, compile and
+// pack itself; hpush enforces upload and release, the whole
+// build, and, as a backstop, builder phases plus phaseGrace.
+// Each can be set with HPUSH_TIMEOUT_{NAME}, e.g.
+// HPUSH_TIMEOUT_COMPILE=20m. Zero means no limit.
+var timeouts = map[string]time.Duration{
+	"build":   30 * time.Minute,
+	"fetch":   2 * time.Minute,
+	"compile": 15 * time.Minute,
+	"pack":    5 * time.Minute,
+	"upload":  5 * time.Minute,
+	"release": 2 * time.Minute,
+}
+
+// builderPhases are the phases the builder times itself.
+var builderPhases = []string{"fetch", "compile", "pack"}
+
+const phaseGrace = 30 * time.Second
+
+// A timeoutError is the cause of a build context that ran
+// out of time.
+type timeoutError struct {
+	Phase string
+	D     time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("%s timed out after %v", e.Phase, e.D)
+}
+
+func loadTimeouts() error {
+	for name := range timeouts {
+		s := os.Getenv("HPUSH_TIMEOUT_" + strings.ToUpper(name))
+		if s == "" {
+			continue
+		}
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return fmt.Errorf("HPUSH_TIMEOUT_%s: %v", strings.ToUpper(name), err)
+		}
+		timeouts[name] = d
+	}
+	return nil
+}
+
+// builderTimeouts formats the builder's phase timeouts for
+// the trampoline, as name=duration pairs.
+func builderTimeouts() string {
+	var a []string
+	for _, name := range builderPhases {
+		if d := timeouts[name]; d > 0 {
+			a = append(a, name+"="+d.String())
+		}
+	}
+	sort.Strings(a)
+	return strings.Join(a, ",")
+}
+
+// withPhaseTimeout returns a context that is done after
+// the timeout for phase, with a *timeoutError as its cause.
+func withPhaseTimeout(ctx context.Context, phase string) (context.Context, context.CancelFunc) {
+	d := timeouts[phase]
+	if d <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeoutCause(ctx, d, &timeoutError{phase, d})
+}
+
+// phaseErr returns the cause of ctx being done if it ran out
+// of time, and err otherwise.
+func phaseErr(ctx context.Context, err error) error {
+	if te, ok := context.Cause(ctx).(*timeoutError); ok {
+		return te
+	}
+	return err
+}
+
+// watchPhase replaces timer t with one that cancels b if the
+// builder phase starting in Phase message p runs well past
+// its timeout, in case the builder fails to stop itself.
+func (b *build) watchPhase(t *time.Timer, p []byte) *time.Timer {
+	if t != nil {
+		t.Stop()
+	}
+	name, start, err := msg.DecodePhase(p)
+	if err != nil || !start || timeouts[name] <= 0 {
+		return nil
+	}
+	d := timeouts[name]
+	return time.AfterFunc(d+phaseGrace, func() {
+		b.cancel(&timeoutError{name, d})
+	})
+}
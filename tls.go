@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"github.com/kr/hpush/msg"
+	"math/big"
+	"net/http"
+	"time"
+)
+
+// TLS for the builder channel. When HPUSH_TLS_PORT is set,
+// hpush also serves on that port over TLS, and builders dial
+// back there, pinning the certificate by its fingerprint.
+var (
+	tlsPort string
+	tlsCert tls.Certificate
+	tlsPin  string // msg.Fingerprint of tlsCert's leaf
+
+	// base64 sha256 of the leaf's public key, for curl
+	tlsKeyPin string
+)
+
+// setupTLS loads the certificate from certFile and keyFile,
+// or makes a self-signed one if they are empty.
+func setupTLS(certFile, keyFile string) (err error) {
+	if certFile != "" || keyFile != "" {
+		tlsCert, err = tls.LoadX509KeyPair(certFile, keyFile)
+	} else {
+		tlsCert, err = selfSignedCert()
+	}
+	if err != nil {
+		return err
+	}
+	tlsPin = msg.Fingerprint(tlsCert.Certificate[0])
+	leaf, err := x509.ParseCertificate(tlsCert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	tlsKeyPin = base64.StdEncoding.EncodeToString(sum[:])
+	return nil
+}
+
+func selfSignedCert() (tls.Certificate, error) {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "hpush"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &priv.PublicKey, priv)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: priv}, nil
+}
+
+// tlsServer returns a server for addr using tlsCert; start
+// it with ListenAndServeTLS("", "").
+func tlsServer(addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:      addr,
+		Handler:   h,
+		TLSConfig: &tls.Config{Certificates: []tls.Certificate{tlsCert}},
+	}
+}